@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/a8m/mark"
+)
+
+// link is a link or an image target, found in a markdown file.
+type link struct {
+	line   int
+	target string
+	err    string // the problem of the link, if any
+}
+
+// links command: list the links and the images targets of the given files,
+// and report the broken ones. it returns the exit status.
+func links(files []string) (status int) {
+	if len(files) == 0 {
+		usageAndExit("links: no input files.")
+	}
+	for _, file := range files {
+		found, err := fileLinks(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			status = 1
+			continue
+		}
+		for _, l := range found {
+			if l.err != "" {
+				fmt.Printf("%s:%d: %s (%s)\n", file, l.line, l.target, l.err)
+				status = 1
+			} else {
+				fmt.Printf("%s:%d: %s\n", file, l.line, l.target)
+			}
+		}
+	}
+	return
+}
+
+// fileLinks parses a markdown file, and returns its links in document order.
+func fileLinks(file string) ([]link, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := mark.New(string(data), mark.DefaultOptions())
+	m.Render()
+	// Headings ids, the targets of the intra-document links
+	ids := make(map[string]bool)
+	for _, block := range m.Nodes {
+		mark.Walk(block, func(n mark.Node) {
+			if h, ok := n.(*mark.HeadingNode); ok {
+				ids[h.ID()] = true
+			}
+		})
+	}
+	var found []link
+	dir := filepath.Dir(file)
+	for _, block := range m.Nodes {
+		mark.Walk(block, func(n mark.Node) {
+			var l link
+			switch n := n.(type) {
+			case *mark.LinkNode:
+				l.target = n.Href
+			case *mark.ImageNode:
+				l.target = n.Src
+			case *mark.RefNode:
+				if def := n.Def(); def != nil {
+					l.target = def.Href
+				} else if shortcut(n) {
+					// An undefined shortcut reference(i.e: "[WIP]") is a plain text
+					return
+				} else {
+					l.target, l.err = "["+n.Ref+"]", "undefined reference"
+				}
+			default:
+				return
+			}
+			l.line, _ = m.Position(n)
+			if l.err == "" {
+				l.err = check(l.target, dir, ids)
+			}
+			found = append(found, l)
+		})
+	}
+	return found, nil
+}
+
+// shortcut tests if a reference has no label, i.e: "[foo]", and not "[foo][]"
+// or "[foo][bar]".
+func shortcut(n *mark.RefNode) bool {
+	return strings.TrimPrefix(n.Raw, "!") == "["+n.Ref+"]"
+}
+
+// check returns the problem of a link target, or an empty string if it's valid.
+// Remote and absolute targets are not checked.
+func check(target, dir string, ids map[string]bool) string {
+	u, err := url.Parse(target)
+	switch {
+	case err != nil:
+		return "invalid URL"
+	case u.Scheme != "" || u.Host != "" || strings.HasPrefix(u.Path, "/"):
+		return ""
+	case u.Path == "":
+		if u.Fragment != "" && !ids[u.Fragment] {
+			return "no such anchor"
+		}
+	default:
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(u.Path))); err != nil {
+			return "no such file"
+		}
+	}
+	return ""
+}
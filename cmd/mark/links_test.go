@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileLinks(t *testing.T) {
+	expected := []link{
+		{3, "other.md", ""},
+		{3, "other.md#section", ""},
+		{5, "missing.md", "no such file"},
+		{5, "#nowhere", "no such anchor"},
+		{7, "#links", ""},
+		{8, "image.png", "no such file"},
+		{10, "https://example.com", ""},
+		{10, "[nope]", "undefined reference"},
+		{11, "other.md", ""},
+	}
+	actual, err := fileLinks("testdata/links.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got\n%+v\nexpected\n%+v", actual, expected)
+	}
+	if _, err := fileLinks("testdata/missing.md"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -19,6 +19,7 @@ var (
 )
 
 var usage = `Usage: mark [options...] <input>
+       mark links <files...>
 
 Options:
   -i  Specify file input, otherwise use last argument as input file. 
@@ -28,13 +29,21 @@ Options:
   -smartypants  Use "smart" typograhic punctuation for things like 
                 quotes and dashes.
   -fractions    Traslate fraction like to suitable HTML elements
+
+Commands:
+  links  List the links and images targets of the files, with their file:line.
+         Undefined references, and relative paths or #anchors that don't exist
+         are reported, and the exit status is 1.
 `
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, fmt.Sprintf(usage))
+		fmt.Fprint(os.Stderr, usage)
 	}
 	flag.Parse()
+	if flag.Arg(0) == "links" {
+		os.Exit(links(flag.Args()[1:]))
+	}
 	// read
 	var reader *bufio.Reader
 	if *input != "" {
@@ -85,7 +94,7 @@ func main() {
 
 func usageAndExit(msg string) {
 	if msg != "" {
-		fmt.Fprintf(os.Stderr, msg)
+		fmt.Fprint(os.Stderr, msg)
 		fmt.Fprintf(os.Stderr, "\n\n")
 	}
 	flag.Usage()
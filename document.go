@@ -0,0 +1,174 @@
+package mark
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Document is a markdown document that can be edited incrementally, e.g: in
+// live preview editors. An edit re-parses only the top-level blocks it affects,
+// and reports the changed nodes, so the preview can be patched.
+type Document struct {
+	*Mark
+}
+
+// Change describes the top-level nodes changed by an edit: Removed nodes
+// from index Start were replaced by Nodes.
+// The task lists checkboxes after the change are re-indexed, so if the number
+// of checkboxes has changed, their rendered data-task attributes are stale.
+type Change struct {
+	Start   int
+	Removed int
+	Nodes   []Node
+}
+
+// NewDocument return a new Document
+func NewDocument(input string, opts *Options) *Document {
+	return &Document{New(input, opts)}
+}
+
+// Render renders the document nodes.
+// The input is parsed if it wasn't parsed yet.
+func (d *Document) Render() string {
+	if d.lex == nil {
+		d.reparse(d.Input)
+	}
+	d.output = ""
+	d.render()
+	return d.output
+}
+
+// RenderNode renders a node of the document, with the custom render functions.
+func (d *Document) RenderNode(n Node) string {
+	return d.renderer().render(n)
+}
+
+// Edit replaces oldLen bytes at the given offset of the input with newText,
+// re-parses the affected blocks and returns the changed nodes.
+// Edits around link definitions re-parse the whole document, since links
+// can reference them from any block.
+func (d *Document) Edit(offset, oldLen int, newText string) (*Change, error) {
+	if offset < 0 || oldLen < 0 || offset+oldLen > len(d.src) {
+		return nil, fmt.Errorf("mark: edit [%d, %d) out of range [0, %d]", offset, offset+oldLen, len(d.src))
+	}
+	if d.lex == nil {
+		d.reparse(d.Input)
+	}
+	// Map the edit to the preprocessed input(tabs are expanded to 4 spaces)
+	start := len(expandTabs(d.src[:offset]))
+	oldText, text := expandTabs(d.src[offset:offset+oldLen]), expandTabs(newText)
+	d.src = d.src[:offset] + newText + d.src[offset+oldLen:]
+	input := d.Input[:start] + text + d.Input[start+len(oldText):]
+	delta := Pos(len(text) - len(oldText))
+	if len(d.starts) == 0 {
+		return d.reparse(input), nil
+	}
+	// An edit can join its block to the previous one(e.g: a paragraph continuation,
+	// or a setext heading underline), so the parsing starts one block before.
+	// Joined blocks share the same start position, and are parsed together.
+	first := func(pos Pos) int {
+		return sort.Search(len(d.starts), func(i int) bool { return d.starts[i] >= pos })
+	}
+	i := first(Pos(start)+1) - 1
+	if i > 0 {
+		i = first(d.starts[i]) - 1
+	}
+	if i > 0 {
+		i = first(d.starts[i])
+	}
+	if i < 0 {
+		i = 0
+	}
+	// The input may start with blank lines
+	p, from := d.parse, Pos(0)
+	if i > 0 {
+		from = d.starts[i]
+	}
+	l := lexFrom(input, from, p.blocks)
+	nodes, starts, tasks := p.Nodes, p.starts, p.tasks
+	p.lex, p.peekCount, p.input, d.lines = l, 0, input, nil
+	p.Nodes, p.starts, p.tasks = nil, nil, nil
+	spans := p.spans
+	if spans != nil {
+		p.spans = make(map[Node][2]Pos)
+	}
+	// Parse until a block starts where a block started before the edit(i.e: the
+	// rest of the input is parsed the same), or until the end of the input.
+	k := len(starts)
+	p.parseUntil(func(t item) bool {
+		if int(t.pos) < start+len(text) {
+			return false
+		}
+		j := sort.Search(len(starts), func(j int) bool { return starts[j] >= t.pos-delta })
+		if j < len(starts) && starts[j] == t.pos-delta {
+			k = j
+			l.stop()
+			return true
+		}
+		return false
+	})
+	end := Pos(len(d.Input))
+	if k < len(starts) {
+		end = starts[k]
+	}
+	if reDefLinkAny.MatchString(d.Input[from:end]) || reDefLinkAny.MatchString(input[from:end+delta]) {
+		p.Nodes = nodes
+		return d.reparse(input), nil
+	}
+	// Splice the new nodes and tasks, and move the rest of the document
+	before := sort.Search(len(tasks), func(j int) bool { return tasks[j].Pos >= from })
+	after := sort.Search(len(tasks), func(j int) bool { return tasks[j].Pos >= end })
+	for _, n := range nodes[k:] {
+		Walk(n, func(n Node) {
+			if n, ok := n.(interface{ shift(Pos) }); ok {
+				n.shift(delta)
+			}
+		})
+	}
+	for j := k; j < len(starts); j++ {
+		starts[j] += delta
+	}
+	for n, span := range spans {
+		if span[0] >= end {
+			p.spans[n] = [2]Pos{span[0] + delta, span[1] + delta}
+		} else if span[0] < from {
+			p.spans[n] = span
+		}
+	}
+	change := &Change{Start: i, Removed: k - i, Nodes: p.Nodes}
+	p.Nodes = append(append(append([]Node{}, nodes[:i]...), p.Nodes...), nodes[k:]...)
+	p.starts = append(append(append([]Pos{}, starts[:i]...), p.starts...), starts[k:]...)
+	all := append(append(append([]*CheckboxNode{}, tasks[:before]...), p.tasks...), tasks[after:]...)
+	for j, t := range all {
+		t.Index = j
+	}
+	p.tasks, d.Input = all, input
+	return change, nil
+}
+
+// reparse parses the whole input, and returns it as a change of all nodes.
+func (d *Document) reparse(input string) *Change {
+	p, removed := d.parse, len(d.Nodes)
+	p.Nodes, p.starts, p.tasks = nil, nil, nil
+	p.links = make(map[string]*DefLinkNode)
+	if p.spans != nil {
+		p.spans = make(map[Node][2]Pos)
+	}
+	d.Input, p.input, d.lines = input, input, nil
+	p.scanRefs(input)
+	p.lex, p.peekCount = lex(input, p.blocks), 0
+	p.parse()
+	return &Change{Start: 0, Removed: removed, Nodes: p.Nodes}
+}
+
+// shift moves a position by delta. nodes embed Pos, so it's used to move
+// the nodes that follow an edit.
+func (p *Pos) shift(delta Pos) {
+	*p += delta
+}
+
+// expandTabs expands the tabs to 4 spaces, the same as New does.
+func expandTabs(s string) string {
+	return strings.Replace(s, "\t", "    ", -1)
+}
@@ -0,0 +1,170 @@
+package mark
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// delimiter represents a run of '*' or '_' characters, that may open or
+// close emphasis. see: http://spec.commonmark.org/0.29/#delimiter-run
+type delimiter struct {
+	char      rune
+	pos       Pos  // position of the run in the input
+	length    int  // original length of the run
+	close     int  // number of characters used from the start of the run(as a closer)
+	open      int  // number of unused characters that follow them
+	canOpen   bool // left-flanking(with the '_' restrictions)
+	canClose  bool // right-flanking(with the '_' restrictions)
+	discarded bool // removed from the delimiter stack
+}
+
+// emphasisSpan holds the boundaries of a resolved emphasis.
+type emphasisSpan struct {
+	typ        itemType
+	start, end Pos
+}
+
+// scanDelimiter consumes a delimiter run and push it to the delimiters stack.
+// The run stays part of the current text, until it is resolved by processEmphasis.
+func (l *lexer) scanDelimiter(char rune) {
+	start := l.pos
+	for l.peek() == char {
+		l.next()
+	}
+	l.delims = append(l.delims, newDelimiter(l.input, start, l.pos))
+}
+
+// scanRefDelimiters push the delimiter runs inside the label of an undefined
+// reference. it's rendered as a text, and an emphasis is allowed to cross its
+// boundaries.
+func (l *lexer) scanRefDelimiters(start, end Pos) {
+	for i := start; i < end; i++ {
+		if c := l.input[i]; c == '*' || c == '_' {
+			j := i
+			for j < end && l.input[j] == c {
+				j++
+			}
+			l.delims = append(l.delims, newDelimiter(l.input, i, j))
+			i = j - 1
+		}
+	}
+}
+
+// newDelimiter returns a delimiter for the run input[start:end], and tests
+// whether it's left-flanking or right-flanking.
+func newDelimiter(input string, start, end Pos) *delimiter {
+	char, _ := utf8.DecodeRuneInString(input[start:])
+	before, _ := utf8.DecodeLastRuneInString(input[:start])
+	after, _ := utf8.DecodeRuneInString(input[end:])
+	// Beginning and end of the line count as whitespace
+	if start == 0 {
+		before = '\n'
+	}
+	if int(end) == len(input) {
+		after = '\n'
+	}
+	left := !isSpace(after) && (!isPunct(after) || isSpace(before) || isPunct(before))
+	right := !isSpace(before) && (!isPunct(before) || isSpace(after) || isPunct(after))
+	d := &delimiter{char: char, pos: start, length: int(end - start)}
+	d.open = d.length
+	if char == '*' {
+		d.canOpen, d.canClose = left, right
+	} else {
+		d.canOpen = left && (!right || isPunct(before))
+		d.canClose = right && (!left || isPunct(after))
+	}
+	return d
+}
+
+// processEmphasis matches openers and closers in the delimiters stack,
+// and returns the outermost emphasis spans, sorted by position.
+// see: http://spec.commonmark.org/0.29/#process-emphasis
+func processEmphasis(delims []*delimiter) (spans []emphasisSpan) {
+	type bottomKey struct {
+		char    rune
+		canOpen bool
+		mod     int
+	}
+	bottom := make(map[bottomKey]int)
+	for c := 0; c < len(delims); c++ {
+		closer := delims[c]
+		if !closer.canClose || closer.discarded || closer.open == 0 {
+			continue
+		}
+		key := bottomKey{closer.char, closer.canOpen, closer.length % 3}
+		floor, ok := bottom[key]
+		if !ok {
+			floor = -1
+		}
+		found := -1
+		for o := c - 1; o > floor; o-- {
+			opener := delims[o]
+			if opener.discarded || opener.open == 0 || !opener.canOpen || opener.char != closer.char {
+				continue
+			}
+			// The multiple of 3 rule
+			if (opener.canClose || closer.canOpen) && (opener.length+closer.length)%3 == 0 &&
+				(opener.length%3 != 0 || closer.length%3 != 0) {
+				continue
+			}
+			found = o
+			break
+		}
+		if found == -1 {
+			bottom[key] = c - 1
+			if !closer.canOpen {
+				closer.discarded = true
+			}
+			continue
+		}
+		opener := delims[found]
+		typ, n := itemItalic, 1
+		if opener.open >= 2 && closer.open >= 2 {
+			typ, n = itemStrong, 2
+		}
+		opener.open -= n
+		closer.open -= n
+		closer.close += n
+		spans = append(spans, emphasisSpan{typ, opener.pos + Pos(opener.close+opener.open), closer.pos + Pos(closer.close)})
+		// Delimiters between the opener and the closer can't be used anymore
+		for i := found + 1; i < c; i++ {
+			delims[i].discarded = true
+		}
+		if opener.open == 0 {
+			opener.discarded = true
+		}
+		// The closer may close another emphasis
+		if closer.open > 0 {
+			c--
+		} else {
+			closer.discarded = true
+		}
+	}
+	// Keep only the outermost spans, the nested ones are resolved
+	// again by the parser when it parses the emphasis content.
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].start == spans[j].start {
+			return spans[i].end > spans[j].end
+		}
+		return spans[i].start < spans[j].start
+	})
+	var outer []emphasisSpan
+	for _, s := range spans {
+		if n := len(outer); n == 0 || s.start >= outer[n-1].end {
+			outer = append(outer, s)
+		}
+	}
+	return outer
+}
+
+// isSpace reports whether r is a unicode whitespace.
+func isSpace(r rune) bool {
+	return unicode.IsSpace(r)
+}
+
+// isPunct reports whether r is an ASCII or unicode punctuation character.
+func isPunct(r rune) bool {
+	return r < utf8.RuneSelf && strings.ContainsRune("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", r) || unicode.IsPunct(r)
+}
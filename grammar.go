@@ -11,18 +11,23 @@ var (
 	reHeading    = regexp.MustCompile(`^ *(#{1,6})(?: +#*| +([^\n]*?)|)(?: +#*|) *(?:\n|$)`)
 	reLHeading   = regexp.MustCompile(`^([^\n]+?) *\n {0,3}(=|-){1,} *(?:\n+|$)`)
 	reBlockQuote = regexp.MustCompile(`^ *>[^\n]*(\n[^\n]+)*\n*`)
+	reAlert      = regexp.MustCompile(`^(?i)\[!(note|tip|important|warning|caution)\] *(?:\n|$)`)
 	reDefLink    = regexp.MustCompile(`(?s)^ *\[([^\]]+)\]: *\n? *<?([^\s>]+)>?(?: *\n? *["'(](.+?)['")])? *(?:\n+|$)`)
+	reDefLinkAny = regexp.MustCompile(`\[[^\]]+\]:`)
 	reSpaceGen   = func(i int) *regexp.Regexp {
 		return regexp.MustCompile(fmt.Sprintf(`(?m)^ {1,%d}`, i))
 	}
 )
 
+// The labels of the link definitions, including the nested ones(blockquotes, lists)
+var reDefLabel = regexp.MustCompile(`(?m)^[ >*+\-\d.)]*\[([^\]]+)\]:`)
+
 var reList = struct {
 	item, marker, loose   *regexp.Regexp
 	scanLine, scanNewLine func(src string) string
 }{
-	regexp.MustCompile(`^( *)(?:[*+-]|\d{1,9}\.) (.*)(?:\n|)`),
-	regexp.MustCompile(`^ *([*+-]|\d+\.) +`),
+	regexp.MustCompile(`^( *)(?:[*+-]|\d{1,9}[.)]) (.*)(?:\n|)`),
+	regexp.MustCompile(`^ *([*+-]|\d+[.)]) +`),
 	regexp.MustCompile(`(?m)\n\n(.*)`),
 	regexp.MustCompile(`^(.*)(?:\n|)`).FindString,
 	regexp.MustCompile(`^\n{1,}`).FindString,
@@ -46,15 +51,40 @@ var reGfmCode = struct {
 	},
 }
 
+var reMath = struct {
+	block, inline, display *regexp.Regexp
+}{
+	regexp.MustCompile(`^ {0,3}\$\$((?:[^$]|\$[^$])*?)\$\$ *(?:\n+|$)`),
+	regexp.MustCompile(`^\$([^\s$](?:[^$]*?[^\s$\\])?)\$`),
+	regexp.MustCompile(`^\$\$((?:[^$]|\$[^$])+?)\$\$`),
+}
+
 var reTable = struct {
-	item, itemLp *regexp.Regexp
-	split        func(s string, n int) []string
-	trim         func(src, repl string) string
+	item, itemLp, caption *regexp.Regexp
+}{
+	regexp.MustCompile(`^ *(\S.*\|.*)\n *([-:]+ *\|[-| :]*)(?:\n|$)((?:.*\|.*(?:\n|$))*)\n*`),
+	regexp.MustCompile(`(^ *\|.+)\n( *\| *[-:]+[-| :]*)(?:\n|$)((?: *\|.*(?:\n|$))*)\n*`),
+	regexp.MustCompile(`^ *\[([^\]]+)\] *$`),
+}
+
+// Attribute lists(e.g: {#id .class key=val}), at the beginning of the text,
+// at the end of the text, and their single attributes.
+const reAttr = `(?:([#.])([\w-]+)|([\w-]+)=(?:"([^"]*)"|'([^']*)'|([^\s"'{}]+)))`
+
+var reAttrList = struct {
+	prefix, suffix, attr *regexp.Regexp
+}{
+	regexp.MustCompile(fmt.Sprintf(`^\{ *(%[1]s(?: +%[1]s)*) *\}`, reAttr)),
+	regexp.MustCompile(fmt.Sprintf(` *\{ *(%[1]s(?: +%[1]s)*) *\} *$`, reAttr)),
+	regexp.MustCompile(reAttr),
+}
+
+// Opening tag of a rendered element, and its attributes.
+var reOpenTag = struct {
+	tag, attr *regexp.Regexp
 }{
-	regexp.MustCompile(`^ *(\S.*\|.*)\n *([-:]+ *\|[-| :]*)\n((?:.*\|.*(?:\n|$))*)\n*`),
-	regexp.MustCompile(`(^ *\|.+)\n( *\| *[-:]+[-| :]*)\n((?: *\|.*(?:\n|$))*)\n*`),
-	regexp.MustCompile(` *\| *`).Split,
-	regexp.MustCompile(`^ *\| *| *\| *$`).ReplaceAllString,
+	regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9]*)((?:\s+[a-zA-Z_:][-a-zA-Z0-9_:.]*(?:="[^"]*")?)*)(\s*/?>)`),
+	regexp.MustCompile(`\s+([a-zA-Z_:][-a-zA-Z0-9_:.]*)(?:="([^"]*)")?`),
 }
 
 var reHTML = struct {
@@ -76,17 +106,17 @@ var reHTML = struct {
 
 // Inline Grammar
 var (
-	reBr        = regexp.MustCompile(`^(?: {2,}|\\)\n`)
-	reLinkText  = `(?:\[[^\]]*\]|[^\[\]]|\])*`
-	reLinkHref  = `\s*<?(.*?)>?(?:\s+['"\(](.*?)['"\)])?\s*`
-	reGfmLink   = regexp.MustCompile(`^(https?:\/\/[^\s<]+[^<.,:;"')\]\s])`)
-	reLink      = regexp.MustCompile(fmt.Sprintf(`(?s)^!?\[(%s)\]\(%s\)`, reLinkText, reLinkHref))
-	reAutoLink  = regexp.MustCompile(`^<([^ >]+(@|:\/)[^ >]+)>`)
-	reRefLink   = regexp.MustCompile(`^!?\[((?:\[[^\]]*\]|[^\[\]]|\])*)\](?:\s*\[([^\]]*)\])?`)
-	reImage     = regexp.MustCompile(fmt.Sprintf(`(?s)^!?\[(%s)\]\(%s\)`, reLinkText, reLinkHref))
-	reCode      = regexp.MustCompile("(?s)^`{1,2}\\s*(.*?[^`])\\s*`{1,2}")
-	reStrike    = regexp.MustCompile(`(?s)^~{2}(.+?)~{2}`)
-	reEmphasise = `(?s)^_{%[1]d}(\S.*?_*)_{%[1]d}|^\*{%[1]d}(\S.*?\**)\*{%[1]d}`
-	reItalic    = regexp.MustCompile(fmt.Sprintf(reEmphasise, 1))
-	reStrong    = regexp.MustCompile(fmt.Sprintf(reEmphasise, 2))
+	reBr       = regexp.MustCompile(`^(?: {2,}|\\)\n`)
+	reLinkText = `(?:\[[^\]]*\]|[^\[\]]|\])*`
+	reLinkHref = `\s*<?(.*?)>?(?:\s+['"\(](.*?)['"\)])?\s*`
+	reGfmLink  = regexp.MustCompile(`^(https?:\/\/[^\s<]+[^<.,:;"')\]\s])`)
+	reLink     = regexp.MustCompile(fmt.Sprintf(`(?s)^!?\[(%s)\]\(%s\)`, reLinkText, reLinkHref))
+	reAutoLink = regexp.MustCompile(`^<([^ >]+(@|:\/)[^ >]+)>`)
+	reRefLink  = regexp.MustCompile(`^!?\[((?:\[[^\]]*\]|[^\[\]]|\])*)\](?:\s*\[([^\]]*)\])?`)
+	reImage    = regexp.MustCompile(fmt.Sprintf(`(?s)^!?\[(%s)\]\(%s\)`, reLinkText, reLinkHref))
+	reCode     = regexp.MustCompile("(?s)^`{1,2}\\s*(.*?[^`])\\s*`{1,2}")
+	reStrike   = regexp.MustCompile(`(?s)^~{2}(.+?)~{2}`)
+	reEntity   = regexp.MustCompile(`&(?:#[xX][0-9a-fA-F]{1,6}|#[0-9]{1,7}|[a-zA-Z][a-zA-Z0-9]{1,31});`)
+	reEmoji    = regexp.MustCompile(`^:([a-z0-9_+\-]+):`)
+	reFraction = regexp.MustCompile(`(\d+)(/\d+)(/\d+|)`)
 )
@@ -3,12 +3,18 @@ package mark
 import (
 	"regexp"
 	"strings"
+	"sync"
 	"unicode/utf8"
 )
 
 // type position
 type Pos int
 
+// position returns the position, in bytes, of a node in the input.
+func (p Pos) position() Pos {
+	return p
+}
+
 // itemType identifies the type of lex items.
 type itemType int
 
@@ -39,6 +45,7 @@ const (
 	itemLpTable
 	itemTableRow
 	itemTableCell
+	itemTableSpan // an empty cell with no spaces(i.e: "||")
 	itemStrong
 	itemItalic
 	itemStrike
@@ -54,6 +61,8 @@ const (
 	itemBr
 	itemPipe
 	itemIndent
+	itemInlineRule
+	itemBlockRule
 )
 
 // stateFn represents the state of the scanner as a function that returns the next state.
@@ -66,30 +75,64 @@ type Lexer interface {
 
 // lexer holds the state of the scanner.
 type lexer struct {
-	input   string    // the string being scanned
-	state   stateFn   // the next lexing function to enter
-	pos     Pos       // current position in the input
-	start   Pos       // start position of this item
-	width   Pos       // width of last rune read from input
-	lastPos Pos       // position of most recent item returned by nextItem
-	items   chan item // channel of scanned items
+	input   string       // the string being scanned
+	state   stateFn      // the next lexing function to enter
+	pos     Pos          // current position in the input
+	start   Pos          // start position of this item
+	width   Pos          // width of last rune read from input
+	lastPos Pos          // position of most recent item returned by nextItem
+	items   chan item    // channel of scanned items
+	pending []item       // inline items waiting for emphasis resolution
+	delims  []*delimiter // emphasis delimiter runs, used by lexInline
+	rules   map[rune][]InlineFn
+	nodes   map[Pos]Node    // nodes created by the inline rules, by position
+	blocks  []*BlockRule    // custom block rules, used by lexAny
+	matched sync.Map        // the rules of the emitted custom blocks, by position
+	done    chan struct{}   // closed to stop the lexer, see lexFrom
+	refs    map[string]bool // defined references labels, used by lexInline
 }
 
 // lex creates a new lexer for the input string.
-func lex(input string) *lexer {
+func lex(input string, blocks []*BlockRule) *lexer {
 	l := &lexer{
-		input: input,
-		items: make(chan item),
+		input:  input,
+		items:  make(chan item),
+		blocks: blocks,
+	}
+	go l.run()
+	return l
+}
+
+// lexFrom creates a new stoppable lexer, that starts scanning the input
+// at the given position. start must be the position of a top-level block.
+func lexFrom(input string, start Pos, blocks []*BlockRule) *lexer {
+	l := &lexer{
+		input:  input,
+		pos:    start,
+		start:  start,
+		items:  make(chan item),
+		blocks: blocks,
+		done:   make(chan struct{}),
 	}
 	go l.run()
 	return l
 }
 
+// stop stops a lexer created by lexFrom, before it reaches the end of the input.
+func (l *lexer) stop() {
+	close(l.done)
+}
+
 // lexInline create a new lexer for one phase lexing(inline blocks).
-func lexInline(input string) *lexer {
+// rules are the custom inline rules, keyed by their trigger rune, and refs
+// are the labels(lowercase) of the defined references.
+func lexInline(input string, rules map[rune][]InlineFn, refs map[string]bool) *lexer {
 	l := &lexer{
 		input: input,
 		items: make(chan item),
+		rules: rules,
+		nodes: make(map[Pos]Node),
+		refs:  refs,
 	}
 	go l.lexInline()
 	return l
@@ -98,7 +141,12 @@ func lexInline(input string) *lexer {
 // run runs the state machine for the lexer.
 func (l *lexer) run() {
 	for l.state = lexAny; l.state != nil; {
-		l.state = l.state(l)
+		select {
+		case <-l.done:
+			l.state = nil
+		default:
+			l.state = l.state(l)
+		}
 	}
 	close(l.items)
 }
@@ -118,6 +166,10 @@ func (l *lexer) next() rune {
 // lexAny scanner is kind of forwarder, it get the current char in the text
 // and forward it to the appropriate scanner based on some conditions.
 func lexAny(l *lexer) stateFn {
+	// Custom rules take precedence over the built-in blocks
+	if l.lexBlockRule() {
+		return lexAny
+	}
 	switch r := l.peek(); r {
 	case '*', '-', '_':
 		return lexHr
@@ -159,6 +211,25 @@ func lexAny(l *lexer) stateFn {
 	}
 }
 
+// lexBlockRule scans a custom block, using the first rule that starts and
+// scans a block at the current position. it reports whether a block was emitted.
+func (l *lexer) lexBlockRule() bool {
+	input := l.input[l.pos:]
+	for _, rule := range l.blocks {
+		if !rule.Start(input) {
+			continue
+		}
+		if n := rule.Scan(input); n > 0 {
+			// The parser reads the rule while the lexer keeps scanning
+			l.matched.Store(l.start, rule)
+			l.pos += Pos(n)
+			l.emit(itemBlockRule)
+			return true
+		}
+	}
+	return false
+}
+
 // lexHeading test if the current text position is an heading item.
 // is so, it will emit an item and return back to lenAny function
 // else, lex it as a simple text value
@@ -269,7 +340,10 @@ func (l *lexer) emit(t itemType, s ...string) {
 	if len(s) == 0 {
 		s = append(s, l.input[l.start:l.pos])
 	}
-	l.items <- item{t, l.start, s[0]}
+	select {
+	case l.items <- item{t, l.start, s[0]}:
+	case <-l.done:
+	}
 	l.start = l.pos
 }
 
@@ -282,31 +356,43 @@ func (l *lexer) nextItem() item {
 
 // One phase lexing(inline reason)
 func (l *lexer) lexInline() {
-	escape := regexp.MustCompile("^\\\\([\\`*{}\\[\\]()#+\\-.!_>~|])")
+	escapable := "\\`*{}\\[\\]()#+\\-.!_>~|"
+	// A dollar sign is escapable when it starts an inline rule(i.e: math)
+	if _, ok := l.rules['$']; ok {
+		escapable += "$"
+	}
+	escape := regexp.MustCompile("^\\\\([" + escapable + "])")
 	// Drain text before emitting
 	emit := func(item itemType, pos int) {
 		if l.pos > l.start {
-			l.emit(itemText)
+			l.push(itemText)
 		}
 		l.pos += Pos(pos)
-		l.emit(item)
+		l.push(item)
 	}
 Loop:
 	for {
-		switch r := l.peek(); r {
+		r := l.peek()
+		// Custom rules take precedence over the built-in syntax
+		if n, node := l.matchRule(r); n > 0 {
+			l.nodes[l.pos] = node
+			emit(itemInlineRule, n)
+			continue
+		}
+		switch r {
 		case eof:
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.push(itemText)
 			}
 			break Loop
 		// backslash escaping
 		case '\\':
 			if m := escape.FindStringSubmatch(l.input[l.pos:]); len(m) != 0 {
 				if l.pos > l.start {
-					l.emit(itemText)
+					l.push(itemText)
 				}
 				l.pos += Pos(len(m[0]))
-				l.emit(itemText, m[1])
+				l.push(itemText, m[1])
 				break
 			}
 			fallthrough
@@ -317,18 +403,11 @@ Loop:
 				break
 			}
 			l.next()
-		case '_', '*', '~', '`':
+		// Emphasis delimiters are resolved after the whole input was scanned.
+		case '_', '*':
+			l.scanDelimiter(r)
+		case '~', '`':
 			input := l.input[l.pos:]
-			// Strong
-			if m := reStrong.FindString(input); m != "" {
-				emit(itemStrong, len(m))
-				break
-			}
-			// Italic
-			if m := reItalic.FindString(input); m != "" {
-				emit(itemItalic, len(m))
-				break
-			}
 			// Strike
 			if m := reStrike.FindString(input); m != "" {
 				emit(itemStrike, len(m))
@@ -352,8 +431,17 @@ Loop:
 				}
 				break
 			}
-			if m := reRefLink.FindString(input); m != "" {
-				pos := len(m)
+			if m := reRefLink.FindStringSubmatch(input); m != nil {
+				pos := len(m[0])
+				// Links bind tighter than emphasis, only the label of an
+				// undefined reference can take part in an emphasis.
+				ref := m[2]
+				if ref == "" {
+					ref = m[1]
+				}
+				if !l.refs[strings.ToLower(ref)] {
+					l.scanRefDelimiters(l.pos, l.pos+Pos(pos))
+				}
 				if r == '[' {
 					emit(itemRefLink, pos)
 				} else {
@@ -372,6 +460,11 @@ Loop:
 				emit(itemHTML, len(res))
 				break
 			}
+			// Inline tags(span elements)
+			if m := reHTML.tag.FindString(l.input[l.pos:]); m != "" {
+				emit(itemHTML, len(m))
+				break
+			}
 			l.next()
 		default:
 			if m := reGfmLink.FindString(l.input[l.pos:]); m != "" {
@@ -381,9 +474,65 @@ Loop:
 			l.next()
 		}
 	}
+	l.flush(processEmphasis(l.delims))
 	close(l.items)
 }
 
+// matchRule tests the custom inline rules of the given trigger rune against
+// the current position, and returns the length and the node of the first match.
+func (l *lexer) matchRule(r rune) (int, Node) {
+	for _, match := range l.rules[r] {
+		if n, node := match(l.input[l.pos:]); n > 0 && node != nil {
+			return n, node
+		}
+	}
+	return 0, nil
+}
+
+// push is like emit, but it holds the item until the inline input was
+// fully scanned and the emphasis delimiters were resolved.
+func (l *lexer) push(t itemType, s ...string) {
+	if len(s) == 0 {
+		s = append(s, l.input[l.start:l.pos])
+	}
+	l.pending = append(l.pending, item{t, l.start, s[0]})
+	l.start = l.pos
+}
+
+// flush emits the pending items, and replaces each outermost emphasis span
+// with a single itemStrong or itemItalic holding its raw source.
+func (l *lexer) flush(spans []emphasisSpan) {
+	var pos Pos
+	for i, t := range l.pending {
+		end := Pos(len(l.input))
+		if i < len(l.pending)-1 {
+			end = l.pending[i+1].pos
+		}
+		for len(spans) > 0 && spans[0].start < end {
+			s := spans[0]
+			// Emphasis inside a reference label is resolved by the parser
+			if t.typ != itemText && s.start >= t.pos && s.end <= end {
+				spans = spans[1:]
+				continue
+			}
+			if s.start > pos {
+				l.items <- item{itemText, pos, l.input[pos:s.start]}
+			}
+			l.items <- item{s.typ, s.start, l.input[s.start:s.end]}
+			pos, spans = s.end, spans[1:]
+		}
+		if end > pos {
+			if pos <= t.pos {
+				l.items <- t
+			} else {
+				l.items <- item{itemText, pos, l.input[pos:end]}
+			}
+			pos = end
+		}
+	}
+	l.pending = nil
+}
+
 // lexHTML.
 func lexHTML(l *lexer) stateFn {
 	if match, res := l.matchHTML(l.input[l.pos:]); match {
@@ -490,8 +639,8 @@ func (l *lexer) matchList(input string) (bool, []string) {
 				break
 			}
 		}
-		// DefLink or hr
-		if reDefLink.MatchString(input) || reHr.MatchString(input) {
+		// DefLink or hr. an indented DefLink belongs to the current item
+		if reDefLink.MatchString(input) && len(input)-len(strings.TrimLeft(input, " ")) <= depth || reHr.MatchString(input) {
 			break
 		}
 		// It's list in the same depth
@@ -543,26 +692,98 @@ func lexBlockQuote(l *lexer) stateFn {
 
 // lexTable
 func lexTable(l *lexer) stateFn {
-	re := reTable.item
+	var table []int
+	input := l.input[l.pos:]
 	if l.peek() == '|' {
-		re = reTable.itemLp
+		table = reTable.itemLp.FindStringSubmatchIndex(input)
 	}
-	table := re.FindStringSubmatch(l.input[l.pos:])
-	l.pos += Pos(len(table[0]))
-	l.start = l.pos
+	// A leading pipe table can be matched by the item regexp only(e.g: an indented delimiter row)
+	if table == nil {
+		table = reTable.item.FindStringSubmatchIndex(input)
+	}
+	start := l.pos
+	l.pos += Pos(table[1])
 	// Ignore the first match, and flat all rows(by splitting \n)
-	rows := append(table[1:3], strings.Split(table[3], "\n")...)
-	for _, row := range rows {
+	rows := []string{input[table[2]:table[3]], input[table[4]:table[5]]}
+	starts := []int{table[2], table[4]}
+	for i, row := table[6], ""; i < table[7]; i += len(row) + 1 {
+		row = strings.SplitN(input[i:table[7]], "\n", 2)[0]
+		rows, starts = append(rows, row), append(starts, i)
+	}
+	for i, row := range rows {
 		if row == "" {
 			continue
 		}
-		l.emit(itemTableRow)
-		rawCells := reTable.trim(row, "")
-		cells := reTable.split(rawCells, -1)
-		// Emit cells in the current row
-		for _, cell := range cells {
-			l.emit(itemTableCell, cell)
+		l.start = start + Pos(starts[i])
+		l.emit(itemTableRow, "")
+		// Emit cells in the current row, positioned at their content
+		cells, offsets := splitCells(row)
+		for j, cell := range cells {
+			typ := itemTableCell
+			if cell == "" {
+				typ = itemTableSpan
+			}
+			indent := len(cell) - len(strings.TrimLeft(cell, " \t"))
+			l.start = start + Pos(starts[i]+offsets[j]+indent)
+			l.emit(typ, strings.TrimSpace(cell))
 		}
 	}
+	l.start = l.pos
 	return lexAny
 }
+
+// splitCells splits a table row into cells, and returns them with their
+// positions in the row. Escaped pipes and pipes inside code spans do not
+// split cells. The leading and the trailing pipes are optional. The cells
+// are not trimmed, to distinguish between an empty cell and a spanning one("||").
+func splitCells(row string) (cells []string, starts []int) {
+	trimmed := strings.TrimSpace(row)
+	base := strings.Index(row, trimmed)
+	row = strings.TrimPrefix(trimmed, "|")
+	base += len(trimmed) - len(row)
+	starts = append(starts, base)
+	var cell string
+	var trailing bool
+	for i := 0; i < len(row); i++ {
+		trailing = false
+		switch c := row[i]; c {
+		case '\\':
+			switch {
+			case i+1 < len(row) && row[i+1] == '|':
+				cell += "|"
+				i++
+			// An escaped backslash doesn't escape the next character
+			case i+1 < len(row) && row[i+1] == '\\':
+				cell += row[i : i+2]
+				i++
+			default:
+				cell += row[i : i+1]
+			}
+		case '`':
+			n := 1
+			for i+n < len(row) && row[i+n] == '`' {
+				n++
+			}
+			fence := row[i : i+n]
+			if j := strings.Index(row[i+n:], fence); j != -1 {
+				cell += strings.Replace(row[i:i+n+j+n], `\|`, "|", -1)
+				i += n + j + n - 1
+			} else {
+				cell += fence
+				i += n - 1
+			}
+		case '|':
+			cells = append(cells, cell)
+			cell, trailing = "", true
+			starts = append(starts, base+i+1)
+		default:
+			cell += row[i : i+1]
+		}
+	}
+	if !trailing {
+		cells = append(cells, cell)
+	} else {
+		starts = starts[:len(cells)]
+	}
+	return
+}
@@ -23,6 +23,7 @@ var itemName = map[itemType]string{
 	itemLpTable:      "LpTable",
 	itemTableRow:     "TableRow",
 	itemTableCell:    "TableCell",
+	itemTableSpan:    "TableSpan",
 	itemText:         "Text",
 	itemLink:         "Link",
 	itemDefLink:      "DefLink",
@@ -37,6 +38,8 @@ var itemName = map[itemType]string{
 	itemRefImage:     "RefImage",
 	itemBr:           "Br",
 	itemPipe:         "Pipe",
+	itemInlineRule:   "InlineRule",
+	itemBlockRule:    "BlockRule",
 }
 
 func (i itemType) String() string {
@@ -199,6 +202,13 @@ var inlineTests = []lexTest{
 	{"italic-2", "_hello_", []item{
 		{itemItalic, 0, "_hello_"},
 	}},
+	{"italic-3", "**hello*", []item{
+		{itemText, 0, "*"},
+		{itemItalic, 0, "*hello*"},
+	}},
+	{"intraword", "snake_case_name", []item{
+		{itemText, 0, "snake_case_name"},
+	}},
 	{"strike", "~~hello~~", []item{
 		{itemStrike, 0, "~~hello~~"},
 	}},
@@ -246,9 +256,9 @@ var inlineTests = []lexTest{
 
 // collect gathers the emitted items into a slice.
 func collect(t *lexTest, isInline bool) (items []item) {
-	l := lex(t.input)
+	l := lex(t.input, nil)
 	if isInline {
-		l = lexInline(t.input)
+		l = lexInline(t.input, nil, nil)
 	}
 	for item := range l.items {
 		items = append(items, item)
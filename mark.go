@@ -1,23 +1,110 @@
 package mark
 
-import "strings"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 // Mark
 type Mark struct {
 	*parse
 	Input string
+	src   string   // the original input, before preprocessing
+	lines [][2]int // start offsets of the lines, in the input and in src
 }
 
 // Mark options used to configure your Mark object
 // set `Smartypants` and `Fractions` to true to enable
 // smartypants and smartfractions rendering.
+// use `Smarty` to configure the smartypants rendering(quotes style, dashes, ...).
+// use `FractionsMode` to render fractions as unicode characters(`FractionsUnicode`,
+// `FractionsSlash`), or `FractionFn` to render them with your own function.
+// set `Typographer` to true to enable typographic replacements, e.g: (c) to ©, -> to →.
+// set `Alerts` to true to render GitHub-style alerts(`> [!NOTE]`).
+// set `Emoji` to true to expand emoji shortcodes(`:tada:`).
+// set `Math` to true to parse math expressions(`$...$` and `$$...$$`).
+// set `MultiMarkdownTables` to true to enable the MultiMarkdown table extensions:
+// spanning cells(`||`), captions(`[caption]`) and rows continued with a trailing `\`.
+// set `TableAlign` to `AlignClass`, `AlignAttr` or `AlignNone` to render the alignment
+// of table cells as a class(`align-center`), an `align` attribute or not at all.
+// set `XHTML` to true to render void elements in XHTML syntax(`<br />`).
+// set `AttributeLists` to true to parse attribute lists(`{#id .class key=val}`) on
+// headings, fenced code blocks, links and images.
+// set `HardWraps` to true to render every new-line in a paragraph as a line-break(`<br>`),
+// or `NoSpaceBreaks` to true to ignore the line-breaks of trailing spaces.
+// set `SourcePos` to true to add the source positions of the blocks to the rendered
+// elements(`data-sourcepos="1:1-2:5"`), e.g: for scroll-sync with an editor.
 type Options struct {
 	Gfm         bool
 	Tables      bool
 	Smartypants bool
+	Smarty      *SmartyOptions
 	Fractions   bool
+	Alerts      bool
+	Emoji       bool
+	Math        bool
+	// Fractions rendering, defaults to FractionsHTML
+	FractionsMode FractionsMode
+	FractionFn    FractionFn
+	// MultiMarkdown tables
+	MultiMarkdownTables bool
+	// Table cells alignment rendering, defaults to inline style
+	TableAlign AlignMode
+	// Output dialect
+	XHTML bool
+	// Kramdown/Pandoc-style attribute lists
+	AttributeLists bool
+	// Typographic replacements
+	Typographer bool
+	// Line-breaks modes
+	HardWraps     bool
+	NoSpaceBreaks bool
+	// Source maps
+	SourcePos bool
 }
 
+// SmartyOptions used to configure the smartypants rendering.
+// The zero value replaces quotes, dashes and ellipses, using English quotes.
+type SmartyOptions struct {
+	Quotes     *Quotes // Quotation marks, defaults to EnglishQuotes
+	NoQuotes   bool    // Don't replace quotes
+	NoDashes   bool    // Don't replace dashes
+	NoEllipses bool    // Don't replace ellipses
+	EmDashes   bool    // Replace "--" with an em-dash, instead of an en-dash
+	Angled     bool    // Replace "<<" and ">>" with guillemets
+}
+
+// FractionsMode identifies how fractions are rendered.
+type FractionsMode int
+
+// Fractions rendering modes. Fractions that have a vulgar fraction character
+// (e.g: ½, ⅔) are rendered as this character, in all modes but FractionsSlash.
+const (
+	FractionsHTML    FractionsMode = iota // <sup>81</sup>&#8260;<sub>100</sub>
+	FractionsUnicode                      // ⁸¹⁄₁₀₀
+	FractionsSlash                        // 81⁄100(fraction slash), for all fractions
+)
+
+// FractionFn used for rendering fractions with a custom function.
+// It gets the numerator and the denominator, and returns the html
+// representation of the fraction.
+type FractionFn func(num, den string) string
+
+// Quotes holds the quotation marks of a locale.
+type Quotes struct {
+	Open, Close             string // Double quotes
+	OpenSingle, CloseSingle string // Single quotes
+}
+
+// Quotation marks for common locales.
+var (
+	EnglishQuotes = Quotes{"\u201c", "\u201d", "\u2018", "\u2019"}
+	GermanQuotes  = Quotes{"\u201e", "\u201c", "\u201a", "\u2018"}
+	// French quotes are separated from the text by narrow no-break spaces
+	FrenchQuotes = Quotes{"\u00ab\u202f", "\u202f\u00bb", "\u2039\u202f", "\u202f\u203a"}
+)
+
 // DefaultOptions return an options struct with default configuration
 // it's means that only Gfm, and Tables set to true.
 func DefaultOptions() *Options {
@@ -29,30 +116,168 @@ func DefaultOptions() *Options {
 
 // New return a new Mark
 func New(input string, opts *Options) *Mark {
+	src := input
 	// Preprocessing
 	input = strings.Replace(input, "\t", "    ", -1)
 	if opts == nil {
 		opts = DefaultOptions()
 	}
-	return &Mark{
+	m := &Mark{
 		Input: input,
-		parse: newParse(input, opts),
+		src:   src,
+		parse: newParse(opts),
+	}
+	if opts.SourcePos {
+		m.attrs = append(m.attrs, m.sourcePos)
 	}
+	return m
 }
 
 // parse and render input
 func (m *Mark) Render() string {
-	m.parse.parse()
+	if m.lex == nil {
+		m.parseInput()
+	}
+	m.output = ""
 	m.render()
 	return m.output
 }
 
+// parseInput parses the input without rendering it. The input is lexed once,
+// the lexer of another call would never be read, since the parser keeps the
+// EOF item of the first one.
+func (m *Mark) parseInput() {
+	m.input, m.lines = m.Input, nil
+	m.scanRefs(m.Input)
+	m.lex = lex(m.Input, m.blocks)
+	m.parse.parse()
+}
+
 // AddRenderFn let you pass NodeType, and RenderFn function
-// and override the default Node rendering
+// and override the default Node rendering, in all nesting levels.
+// Use node.Render() inside the RenderFn to get the default rendering.
 func (m *Mark) AddRenderFn(typ NodeType, fn RenderFn) {
 	m.renderFn[typ] = fn
 }
 
+// AddInlineRule let you extend the inline syntax with custom constructs
+// (e.g: @mentions, :emoji: or [[wiki links]]). match is called when the trigger
+// rune is encountered in the text, and the returned node can be rendered with
+// its own NodeType, using AddRenderFn.
+// Custom rules are tested before the built-in inline syntax.
+func (m *Mark) AddInlineRule(trigger rune, match InlineFn) {
+	m.rules[trigger] = append(m.rules[trigger], match)
+}
+
+// AddBlockRule let you extend the block syntax with custom constructs
+// (e.g: :::note containers, math blocks, directives).
+// Custom rules are tested before the built-in block syntax.
+func (m *Mark) AddBlockRule(rule *BlockRule) {
+	m.blocks = append(m.blocks, rule)
+}
+
+// AddDiagramFn let you pass a code language(e.g: mermaid), and a DiagramFn
+// function that renders the fenced code blocks of this language, instead of
+// the default code rendering.
+func (m *Mark) AddDiagramFn(lang string, fn DiagramFn) {
+	m.diagrams[lang] = fn
+}
+
+// AddAttributesFn let you pass an AttributesFn function, that returns the
+// attributes to add to the element of a node(e.g: rel="nofollow" on links, or
+// loading="lazy" on images). The attributes are merged into the first tag of
+// the default rendering, in all nesting levels.
+func (m *Mark) AddAttributesFn(fn AttributesFn) {
+	m.attrs = append(m.attrs, fn)
+}
+
+// Tasks returns the task lists checkboxes, in document order.
+// The input is parsed if it wasn't parsed yet.
+func (m *Mark) Tasks() []*CheckboxNode {
+	if m.lex == nil {
+		m.parseInput()
+	}
+	return m.tasks
+}
+
+// ToggleTask toggles the nth(zero based) task list checkbox, and returns
+// the updated input. e.g: "- [ ] foo" becomes "- [x] foo", and vice versa.
+func (m *Mark) ToggleTask(n int) (string, error) {
+	tasks := m.Tasks()
+	if n < 0 || n >= len(tasks) {
+		return "", fmt.Errorf("mark: task %d out of range [0, %d)", n, len(tasks))
+	}
+	// Map the checkbox position to the original input(tabs are expanded to 4 spaces)
+	pos, i := int(tasks[n].Pos), 0
+	for j := 0; j < pos && i < len(m.src); i++ {
+		if m.src[i] == '\t' {
+			j += 4
+		} else {
+			j++
+		}
+	}
+	if i+2 >= len(m.src) || m.src[i] != '[' || m.src[i+2] != ']' {
+		return "", fmt.Errorf("mark: task %d not found in the input", n)
+	}
+	mark := "x"
+	if tasks[n].Checked {
+		mark = " "
+	}
+	return m.src[:i+1] + mark + m.src[i+2:], nil
+}
+
+// sourcePos returns the data-sourcepos attribute of a block, in the form of
+// "startLine:col-endLine:col", like cmark does. it's used when SourcePos is enabled.
+func (m *Mark) sourcePos(n Node) map[string]string {
+	switch n.Type() {
+	case NodeParagraph, NodeHeading, NodeCode, NodeList, NodeListItem, NodeTable, NodeBlockQuote, NodeAlert:
+	default:
+		return nil
+	}
+	span, ok := m.spans[n]
+	if !ok {
+		return nil
+	}
+	sl, sc := m.lineCol(span[0])
+	el, ec := m.lineCol(span[1])
+	return map[string]string{"data-sourcepos": fmt.Sprintf("%d:%d-%d:%d", sl, sc, el, ec)}
+}
+
+// Position returns the line and the column(1-based) of a node in the input.
+// It returns 0, 0 for nodes that have no position(e.g: nodes of custom rules).
+func (m *Mark) Position(n Node) (line, col int) {
+	p, ok := n.(interface{ position() Pos })
+	if !ok {
+		return 0, 0
+	}
+	return m.lineCol(p.position())
+}
+
+// lineCol returns the line and the column(1-based) of a position in the input.
+// The column is the byte offset in the original line(tabs are expanded to 4 spaces).
+func (m *Mark) lineCol(pos Pos) (int, int) {
+	if m.lines == nil {
+		m.lines = [][2]int{{0, 0}}
+		for i, j := 0, 0; i < len(m.src); i++ {
+			if j++; m.src[i] == '\t' {
+				j += 3
+			}
+			if m.src[i] == '\n' {
+				m.lines = append(m.lines, [2]int{j, i + 1})
+			}
+		}
+	}
+	line := sort.Search(len(m.lines), func(i int) bool { return m.lines[i][0] > int(pos) }) - 1
+	col, i := 0, m.lines[line][1]
+	for j := m.lines[line][0]; j < int(pos) && i < len(m.src); i++ {
+		if j++; m.src[i] == '\t' {
+			j += 3
+		}
+		col++
+	}
+	return line + 1, col + 1
+}
+
 // Staic render function
 func Render(input string) string {
 	m := New(input, nil)
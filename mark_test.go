@@ -1,10 +1,14 @@
 package mark
 
 import (
+	"fmt"
 	"io/ioutil"
+	"reflect"
 	"regexp"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestRender(t *testing.T) {
@@ -16,20 +20,30 @@ func TestRender(t *testing.T) {
 		"__bar__ foo":          "<p><strong>bar</strong> foo</p>",
 		"**bar** foo __bar__":  "<p><strong>bar</strong> foo <strong>bar</strong></p>",
 		"**bar**__baz__":       "<p><strong>bar</strong><strong>baz</strong></p>",
-		"**bar**foo__bar__":    "<p><strong>bar</strong>foo<strong>bar</strong></p>",
-		"_bar_baz":             "<p><em>bar</em>baz</p>",
+		"**bar**foo__bar__":    "<p><strong>bar</strong>foo__bar__</p>",
+		"_bar_baz":             "<p>_bar_baz</p>",
 		"_foo_~~bar~~ baz":     "<p><em>foo</em><del>bar</del> baz</p>",
 		"~~baz~~ _baz_":        "<p><del>baz</del> <em>baz</em></p>",
 		"`bool` and thats it.": "<p><code>bool</code> and thats it.</p>",
 		// Html
 		"<!--hello-->": "<!--hello-->",
 		// Emphasis mixim
-		"___foo___":       "<p><strong><em>foo</em></strong></p>",
+		"___foo___":       "<p><em><strong>foo</strong></em></p>",
 		"__foo _bar___":   "<p><strong>foo <em>bar</em></strong></p>",
 		"__*foo*__":       "<p><strong><em>foo</em></strong></p>",
 		"_**mixim**_":     "<p><em><strong>mixim</strong></em></p>",
 		"~~__*mixim*__~~": "<p><del><strong><em>mixim</em></strong></del></p>",
 		"~~*mixim*~~":     "<p><del><em>mixim</em></del></p>",
+		// Emphasis delimiter runs
+		"snake_case_name":       "<p>snake_case_name</p>",
+		"foo*bar*":              "<p>foo<em>bar</em></p>",
+		"**foo*":                "<p>*<em>foo</em></p>",
+		"*foo _bar* baz_":       "<p><em>foo _bar</em> baz_</p>",
+		"*foo**bar**baz*":       "<p><em>foo<strong>bar</strong>baz</em></p>",
+		"*(**foo**)*":           "<p><em>(<strong>foo</strong>)</em></p>",
+		"*a `*` b*":             "<p><em>a <code>*</code> b</em></p>",
+		"__foo, __bar__, baz__": "<p><strong>foo, <strong>bar</strong>, baz</strong></p>",
+		"a * b * c":             "<p>a * b * c</p>",
 		// Paragraph
 		"1  \n2  \n3":        "<p>1<br>2<br>3</p>",
 		"1\n\n2":             "<p>1</p>\n<p>2</p>",
@@ -60,6 +74,12 @@ func TestRender(t *testing.T) {
 		// Hr
 		"foo\n****\nbar": "<p>foo</p>\n<hr>\n<p>bar</p>",
 		"foo\n___":       "<p>foo</p>\n<hr>",
+		// Tables
+		"a | b\n--|--":                               "<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n</table>",
+		"a | b\n--|--\n`x|y` | c\\|d":                "<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td><code>x|y</code></td>\n<td>c|d</td>\n</tr>\n</tbody>\n</table>",
+		"| a | b |\n|---|---|\n| 1 |\n| 1 | 2 | 3 |": "<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>1</td>\n<td></td>\n</tr>\n<tr>\n<td>1</td>\n<td>2</td>\n</tr>\n</tbody>\n</table>",
+		"a | b\n--|--\ncafé | 日本":                    "<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>café</td>\n<td>日本</td>\n</tr>\n</tbody>\n</table>",
+		"a | b\n--|--\nx\\\\| y\\| z":                "<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>x\\\\</td>\n<td>y| z</td>\n</tr>\n</tbody>\n</table>",
 		// Images
 		"![name](url)":           "<p><img src=\"url\" alt=\"name\"></p>",
 		"![name](url \"title\")": "<p><img src=\"url\" alt=\"name\" title=\"title\"></p>",
@@ -71,18 +91,27 @@ func TestRender(t *testing.T) {
 		// // Ordered Lists
 		"1. one\n2. two\n3. three": "<ol>\n<li>one</li>\n<li>two</li>\n<li>three</li>\n</ol>",
 		"1. one\n 1. one of one":   "<ol>\n<li>one<ol>\n<li>one of one</li>\n</ol></li>\n</ol>",
-		"2. two\n 3. three":        "<ol>\n<li>two<ol>\n<li>three</li>\n</ol></li>\n</ol>",
+		"2. two\n 3. three":        "<ol start=\"2\">\n<li>two<ol start=\"3\">\n<li>three</li>\n</ol></li>\n</ol>",
+		"3) one\n4) two":           "<ol start=\"3\">\n<li>one</li>\n<li>two</li>\n</ol>",
 		// Task list
-		"- [ ] foo\n- [ ] bar": "<ul>\n<li><input type=\"checkbox\">foo</li>\n<li><input type=\"checkbox\">bar</li>\n</ul>",
-		"- [x] foo\n- [x] bar": "<ul>\n<li><input type=\"checkbox\" checked>foo</li>\n<li><input type=\"checkbox\" checked>bar</li>\n</ul>",
-		"- [ ] foo\n- [x] bar": "<ul>\n<li><input type=\"checkbox\">foo</li>\n<li><input type=\"checkbox\" checked>bar</li>\n</ul>",
+		"- [ ] foo\n- [ ] bar": "<ul>\n<li><input type=\"checkbox\" disabled data-task=\"0\">foo</li>\n<li><input type=\"checkbox\" disabled data-task=\"1\">bar</li>\n</ul>",
+		"- [x] foo\n- [x] bar": "<ul>\n<li><input type=\"checkbox\" checked disabled data-task=\"0\">foo</li>\n<li><input type=\"checkbox\" checked disabled data-task=\"1\">bar</li>\n</ul>",
+		"- [ ] foo\n- [x] bar": "<ul>\n<li><input type=\"checkbox\" disabled data-task=\"0\">foo</li>\n<li><input type=\"checkbox\" checked disabled data-task=\"1\">bar</li>\n</ul>",
 		// Special characters escaping
 		"< hello":   "<p>&lt; hello</p>",
 		"hello >":   "<p>hello &gt;</p>",
 		"foo & bar": "<p>foo &amp; bar</p>",
 		"'foo'":     "<p>&#39;foo&#39;</p>",
 		"\"foo\"":   "<p>&quot;foo&quot;</p>",
-		"&copy;":    "<p>&copy;</p>",
+		"&copy;":    "<p>©</p>",
+		// Entity and numeric character references
+		"&nbsp;&AElig; &amp;":               "<p>\u00a0Æ &amp;</p>",
+		"&#123; &#x1F600;":                  "<p>{ 😀</p>",
+		"&#0; &#X22;":                       "<p>\ufffd &quot;</p>",
+		"&foo; &copy":                       "<p>&amp;foo; &amp;copy</p>",
+		"&lt;b&gt;":                         "<p>&lt;b&gt;</p>",
+		"`&amp;`":                           "<p><code>&amp;amp;</code></p>",
+		"[&amp;](/?a=1&amp;b=2 \"&quot;\")": "<p><a href=\"/?a=1&amp;b=2\" title=\"&quot;\">&amp;</a></p>",
 		// Backslash escaping
 		"\\**foo\\**":       "<p>*<em>foo*</em></p>",
 		"\\*foo\\*":         "<p>*foo*</p>",
@@ -126,6 +155,18 @@ func TestData(t *testing.T) {
 			opts.Smartypants = true
 			output = New(string(text), opts).Render()
 		}
+		if strings.Contains(file, "math") {
+			opts.Math = true
+			output = New(string(text), opts).Render()
+		}
+		if strings.Contains(file, "alerts") {
+			opts.Alerts = true
+			output = New(string(text), opts).Render()
+		}
+		if strings.Contains(file, "mmd_tables") {
+			opts.MultiMarkdownTables = true
+			output = New(string(text), opts).Render()
+		}
 		if strings.Contains(file, "smartyfractions") {
 			opts.Fractions = true
 			output = New(string(text), opts).Render()
@@ -138,6 +179,29 @@ func TestData(t *testing.T) {
 }
 
 // TODO: Add more tests for it.
+func TestRenderLexer(t *testing.T) {
+	m := New("- [ ] foo", nil)
+	m.Tasks()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		m.Render()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Render: got %d goroutines, expected %d", after, before)
+	}
+	// The tasks are parsed without rendering the input
+	expected := "<ul>\n<li><input type=\"checkbox\" disabled data-task=\"0\">foo</li>\n</ul>"
+	if actual := m.Render(); actual != expected {
+		t.Errorf("Render after Tasks: got\n%+v\nexpected\n%+v", actual, expected)
+	}
+	m = New("- [ ] foo", nil)
+	m.ToggleTask(0)
+	if actual := m.Render(); actual != expected {
+		t.Errorf("Render after ToggleTask: got\n%+v\nexpected\n%+v", actual, expected)
+	}
+}
+
 func TestRenderFn(t *testing.T) {
 	m := New("hello world", nil)
 	m.AddRenderFn(NodeParagraph, func(n Node) (s string) {
@@ -156,6 +220,667 @@ func TestRenderFn(t *testing.T) {
 	}
 }
 
+func TestNestedRenderFn(t *testing.T) {
+	input := "[a](/a) and __[b][b]__\n\n> - [c](/c)\n\n[b]: /b"
+	m := New(input, nil)
+	m.AddRenderFn(NodeLink, func(n Node) string {
+		l, _ := n.(*LinkNode)
+		return "<a href=\"" + l.Href + "\" rel=\"nofollow\">" + l.Href + "</a>"
+	})
+	// Using the default rendering, the children are still overridden
+	m.AddRenderFn(NodeListItem, func(n Node) string {
+		return "[" + n.Render() + "]"
+	})
+	expected := "<p><a href=\"/a\" rel=\"nofollow\">/a</a> and <strong><a href=\"/b\" rel=\"nofollow\">/b</a></strong></p>\n" +
+		"<blockquote><ul>\n[<li><a href=\"/c\" rel=\"nofollow\">/c</a></li>]\n</ul></blockquote>"
+	if actual := m.Render(); actual != expected {
+		t.Errorf("NestedRenderFn: got\n\t%+v\nexpected\n\t%+v", actual, expected)
+	}
+}
+
+// MentionNode is a custom node, used to test inline rules.
+type MentionNode struct {
+	NodeType
+	Pos
+	Name string
+}
+
+func (n *MentionNode) Render() string {
+	return "@" + n.Name
+}
+
+const NodeMention NodeType = 100
+
+func TestInlineRule(t *testing.T) {
+	reMention := regexp.MustCompile(`^@([a-z]+)`)
+	reWiki := regexp.MustCompile(`^\[\[([^\]]+)\]\]`)
+	cases := map[string]string{
+		"hi @ariel!":             "<p>hi <a href=\"/ariel\">@ariel</a>!</p>",
+		"__@ariel__ `@ariel`":    "<p><strong><a href=\"/ariel\">@ariel</a></strong> <code>@ariel</code></p>",
+		"see [[Home]] or [a](b)": "<p>see <a href=\"/wiki/Home\">Home</a> or <a href=\"b\">a</a></p>",
+		"- _[[x]]_ and @":        "<ul>\n<li><em><a href=\"/wiki/x\">x</a></em> and @</li>\n</ul>",
+	}
+	for input, expected := range cases {
+		m := New(input, nil)
+		m.AddInlineRule('@', func(s string) (int, Node) {
+			if m := reMention.FindStringSubmatch(s); m != nil {
+				return len(m[0]), &MentionNode{NodeType: NodeMention, Name: m[1]}
+			}
+			return 0, nil
+		})
+		m.AddInlineRule('[', func(s string) (int, Node) {
+			if m := reWiki.FindStringSubmatch(s); m != nil {
+				return len(m[0]), &LinkNode{NodeType: NodeLink, Href: "/wiki/" + m[1], Nodes: []Node{&TextNode{Text: m[1]}}}
+			}
+			return 0, nil
+		})
+		m.AddRenderFn(NodeMention, func(n Node) string {
+			return "<a href=\"/" + n.(*MentionNode).Name + "\">" + n.Render() + "</a>"
+		})
+		if actual := m.Render(); actual != expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", input, actual, expected)
+		}
+	}
+}
+
+func TestDiagramFn(t *testing.T) {
+	input := "```mermaid\ngraph TD;\n  A-->B;\n```\n\n```dot\ndigraph {}\n```\n\n```js\na < b\n```"
+	m := New(input, nil)
+	m.AddDiagramFn("mermaid", func(src string) (string, error) {
+		return "<div class=\"mermaid\">" + src + "</div>", nil
+	})
+	m.AddDiagramFn("dot", func(src string) (string, error) {
+		return "", fmt.Errorf("dot: failed to render")
+	})
+	expected := "<div class=\"mermaid\">\ngraph TD;\n  A-->B;\n</div>\n" +
+		"<pre><code class=\"lang-dot\">\ndigraph {}\n</code></pre>\n" +
+		"<pre><code class=\"lang-js\">\na &lt; b\n</code></pre>"
+	if actual := m.Render(); actual != expected {
+		t.Errorf("DiagramFn: got\n\t%+v\nexpected\n\t%+v", actual, expected)
+	}
+	// The render functions get the escaped code
+	m = New("```html\n<script>x</script>\n```", nil)
+	m.AddRenderFn(NodeCode, func(n Node) string {
+		return "<pre>" + n.(*CodeNode).Text + "</pre>"
+	})
+	expected = "<pre>\n&lt;script&gt;x&lt;/script&gt;\n</pre>"
+	if actual := m.Render(); actual != expected {
+		t.Errorf("CodeNode.Text: got\n\t%+v\nexpected\n\t%+v", actual, expected)
+	}
+}
+
+func TestEmoji(t *testing.T) {
+	cases := map[string]string{
+		":tada: and :+1:":               "<p>\U0001f389 and \U0001f44d</p>",
+		"__:smile:__ `:smile:`":         "<p><strong>\U0001f604</strong> <code>:smile:</code></p>",
+		"    :smile:":                   "<pre><code>:smile:</code></pre>",
+		":unknown: at 10:30:00":         "<p>:unknown: at 10:30:00</p>",
+		"- [:tada:](http://x.com/:+1:)": "<ul>\n<li><a href=\"http://x.com/:+1:\">\U0001f389</a></li>\n</ul>",
+	}
+	opts := DefaultOptions()
+	opts.Emoji = true
+	for input, expected := range cases {
+		if actual := New(input, opts).Render(); actual != expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", input, actual, expected)
+		}
+	}
+	// Render as images
+	m := New("hi :tada:", opts)
+	m.AddRenderFn(NodeEmoji, func(n Node) string {
+		e := n.(*EmojiNode)
+		return "<img class=\"emoji\" alt=\"" + e.Glyph + "\" src=\"/" + e.Name + ".png\">"
+	})
+	expected := "<p>hi <img class=\"emoji\" alt=\"\U0001f389\" src=\"/tada.png\"></p>"
+	if actual := m.Render(); actual != expected {
+		t.Errorf("Emoji images: got\n%+v\nexpected\n%+v", actual, expected)
+	}
+	// Disabled by default
+	if actual := Render(":tada:"); actual != "<p>:tada:</p>" {
+		t.Errorf("Emoji disabled: got\n%+v", actual)
+	}
+}
+
+func TestListNode(t *testing.T) {
+	cases := []struct {
+		input string
+		list  ListNode
+	}{
+		{"- foo\n- bar", ListNode{BulletChar: '-', Tight: true}},
+		{"+ foo\n\n+ bar", ListNode{BulletChar: '+'}},
+		{"007. foo\n8. bar", ListNode{Ordered: true, Start: 7, Delimiter: '.', Tight: true}},
+		{"1) foo", ListNode{Ordered: true, Start: 1, Delimiter: ')', Tight: true}},
+	}
+	for _, c := range cases {
+		m := New(c.input, nil)
+		m.Render()
+		l := m.Nodes[0].(*ListNode)
+		if l.Ordered != c.list.Ordered || l.Start != c.list.Start || l.Delimiter != c.list.Delimiter ||
+			l.BulletChar != c.list.BulletChar || l.Tight != c.list.Tight {
+			t.Errorf("%q: got\n%+v\nexpected\n%+v", c.input, *l, c.list)
+		}
+	}
+}
+
+func TestTableNode(t *testing.T) {
+	cases := []struct {
+		input        string
+		header, body int
+	}{
+		{"a | b\n--|--\n1 | 2\n3 | 4", 1, 2},
+		{"a | b\n--|--", 1, 0},
+		{"| a | b |\n| c | d |\n|---|---|\n| 1 | 2 |", 2, 1},
+	}
+	opts := DefaultOptions()
+	opts.MultiMarkdownTables = true
+	for _, c := range cases {
+		m := New(c.input, opts)
+		m.Render()
+		table := m.Nodes[0].(*TableNode)
+		if len(table.Header) != c.header || len(table.Body) != c.body {
+			t.Errorf("%q: got %d header rows and %d body rows\nexpected %d and %d",
+				c.input, len(table.Header), len(table.Body), c.header, c.body)
+		}
+		// The deprecated Rows field holds all the rows
+		if len(table.Rows) != c.header+c.body || table.Rows[0] != table.Header[0] {
+			t.Errorf("%q: unexpected Rows: %+v", c.input, table.Rows)
+		}
+	}
+	// A caption below a table with a caption above it, is a paragraph
+	input := "[Top]\n| a | b |\n|---|---|\n| 1 | 2 |\n[Bottom]"
+	expected := "<table>\n<caption>Top</caption>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n" +
+		"<tbody>\n<tr>\n<td>1</td>\n<td>2</td>\n</tr>\n</tbody>\n</table>\n<p>[Bottom]</p>"
+	if actual := New(input, opts).Render(); actual != expected {
+		t.Errorf("%q: got\n%+v\nexpected\n%+v", input, actual, expected)
+	}
+}
+
+func TestTaskList(t *testing.T) {
+	cases := map[string]string{
+		"- [X] foo":              "<ul>\n<li><input type=\"checkbox\" checked disabled data-task=\"0\">foo</li>\n</ul>",
+		"- [ ] foo\n\n- [x] bar": "<ul>\n<li><p><input type=\"checkbox\" disabled data-task=\"0\">foo</p></li>\n<li><p><input type=\"checkbox\" checked disabled data-task=\"1\">bar</p></li>\n</ul>",
+		"- [ ] foo\n  - [x] bar": "<ul>\n<li><input type=\"checkbox\" disabled data-task=\"0\">foo<ul>\n<li><input type=\"checkbox\" checked disabled data-task=\"1\">bar</li>\n</ul></li>\n</ul>",
+		"- [x]foo\n- [ ]":        "<ul>\n<li>[x]foo</li>\n<li>[ ]</li>\n</ul>",
+	}
+	for input, expected := range cases {
+		if actual := Render(input); actual != expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", input, actual, expected)
+		}
+	}
+	// Source offsets and toggling
+	input := "- [ ] foo\n\t- [x] bar\n\n> 1. [ ] baz\n>    * [X] qux"
+	m := New(input, nil)
+	tasks := m.Tasks()
+	if len(tasks) != 4 {
+		t.Fatalf("Tasks: got %d tasks, expected 4", len(tasks))
+	}
+	for i, task := range tasks {
+		if task.Index != i || m.Input[task.Pos] != '[' {
+			t.Errorf("Task %d: got index %d at offset %d", i, task.Index, task.Pos)
+		}
+	}
+	toggled := []string{
+		"- [x] foo\n\t- [x] bar\n\n> 1. [ ] baz\n>    * [X] qux",
+		"- [ ] foo\n\t- [ ] bar\n\n> 1. [ ] baz\n>    * [X] qux",
+		"- [ ] foo\n\t- [x] bar\n\n> 1. [x] baz\n>    * [X] qux",
+		"- [ ] foo\n\t- [x] bar\n\n> 1. [ ] baz\n>    * [ ] qux",
+	}
+	for i, expected := range toggled {
+		if actual, err := m.ToggleTask(i); err != nil || actual != expected {
+			t.Errorf("ToggleTask(%d): got\n%q, %v\nexpected\n%q", i, actual, err, expected)
+		}
+	}
+	if _, err := m.ToggleTask(4); err == nil {
+		t.Error("ToggleTask: expected an out of range error")
+	}
+}
+
+func TestAttributesFn(t *testing.T) {
+	input := "[a](http://a.com) [b](/b) ![c](c.png)\n\n" +
+		"```go\nfoo\n```\n\n" +
+		"- [x] task\n\n" +
+		"a | b\n--|:-:\n1 | 2"
+	m := New(input, nil)
+	m.AddAttributesFn(func(node Node) map[string]string {
+		switch n := node.(type) {
+		case *LinkNode:
+			if strings.HasPrefix(n.Href, "http") {
+				return map[string]string{"target": "_blank", "rel": "nofollow noopener"}
+			}
+		case *ImageNode:
+			return map[string]string{"loading": "lazy"}
+		case *TableNode:
+			return map[string]string{"class": "table"}
+		case *CellNode:
+			return map[string]string{"class": "cell", "style": "color:red"}
+		case *CodeNode:
+			return map[string]string{"class": "code"}
+		case *CheckboxNode:
+			return map[string]string{"class": "task"}
+		}
+		return nil
+	})
+	expected := `<p><a href="http://a.com" rel="nofollow noopener" target="_blank">a</a> <a href="/b">b</a> <img src="c.png" alt="c" loading="lazy"></p>
+<pre class="code"><code class="lang-go">
+foo
+</code></pre>
+<ul>
+<li><input type="checkbox" checked disabled data-task="0" class="task">task</li>
+</ul>
+<table class="table">
+<thead>
+<tr>
+<th class="cell" style="color:red">a</th>
+<th style="text-align:center;color:red" class="cell">b</th>
+</tr>
+</thead>
+<tbody>
+<tr>
+<td class="cell" style="color:red">1</td>
+<td style="text-align:center;color:red" class="cell">2</td>
+</tr>
+</tbody>
+</table>`
+	if actual := m.Render(); actual != expected {
+		t.Errorf("AttributesFn: got\n%+v\nexpected\n%+v", actual, expected)
+	}
+}
+
+func TestAttributeLists(t *testing.T) {
+	cases := map[string]string{
+		"# Install {#install .big}":         "<h1 id=\"install\" class=\"big\">Install</h1>",
+		"Setup {.a .b data-x=\"1 2\"}\n===": "<h1 id=\"setup\" class=\"a b\" data-x=\"1 2\">Setup</h1>",
+		"# Not {attrs}":                     "<h1 id=\"not-attrs-\">Not {attrs}</h1>",
+		"![logo](x.png){width=200} text":    "<p><img src=\"x.png\" alt=\"logo\" width=\"200\"> text</p>",
+		"[a](/a){.btn target='_blank'}!":    "<p><a href=\"/a\" class=\"btn\" target=\"_blank\">a</a>!</p>",
+		"[a](/a) {.btn}":                    "<p><a href=\"/a\">a</a> {.btn}</p>",
+		"```go {#main .numbers}\nfoo\n```":  "<pre class=\"numbers\" id=\"main\"><code class=\"lang-go\">\nfoo\n</code></pre>",
+		"```{.python}\nfoo\n```":            "<pre><code class=\"lang-python\">\nfoo\n</code></pre>",
+	}
+	opts := DefaultOptions()
+	opts.AttributeLists = true
+	for input, expected := range cases {
+		if actual := New(input, opts).Render(); actual != expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", input, actual, expected)
+		}
+	}
+	// Disabled by default
+	if actual := Render("# Install {#install}"); actual != "<h1 id=\"install-install-\">Install {#install}</h1>" {
+		t.Errorf("AttributeLists disabled: got\n%+v", actual)
+	}
+}
+
+func TestRulesPos(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Math, opts.Emoji, opts.HardWraps = true, true, true
+	m := New("a $x$ :tada:\nb\n\n$$\ny\n$$", opts)
+	m.Render()
+	nodes := m.Nodes[0].(*ParagraphNode).Nodes
+	positions := []Pos{nodes[1].(*MathNode).Pos, nodes[3].(*EmojiNode).Pos, nodes[4].(*BrNode).Pos}
+	for i, expected := range []Pos{2, 6, 12} {
+		if positions[i] != expected {
+			t.Errorf("Inline rule node %d: got position %d, expected %d", i, positions[i], expected)
+		}
+	}
+	if n := m.Nodes[1].(*MathNode); n.Pos != 16 {
+		t.Errorf("Block rule node: got position %d, expected 16", n.Pos)
+	}
+}
+
+func TestLineBreaks(t *testing.T) {
+	cases := []struct {
+		hardWraps, noSpaceBreaks bool
+		expected                 string
+	}{
+		{false, false, "<p>a<br>b\nc<br>d <code>e\nf</code></p>"},
+		{true, false, "<p>a<br>b<br>c<br>d <code>e\nf</code></p>"},
+		{false, true, "<p>a\nb\nc<br>d <code>e\nf</code></p>"},
+	}
+	input := "a  \nb\nc\\\nd `e\nf`"
+	for _, c := range cases {
+		opts := DefaultOptions()
+		opts.HardWraps, opts.NoSpaceBreaks = c.hardWraps, c.noSpaceBreaks
+		if actual := New(input, opts).Render(); actual != c.expected {
+			t.Errorf("HardWraps: %v, NoSpaceBreaks: %v: got\n%q\nexpected\n%q", c.hardWraps, c.noSpaceBreaks, actual, c.expected)
+		}
+	}
+}
+
+func TestSmartypants(t *testing.T) {
+	input := `"It's 'ok'" -- << yes >>... [a--b](/a--b "x--y")`
+	cases := []struct {
+		smarty   *SmartyOptions
+		expected string
+	}{
+		{nil, "<p>\u201cIt\u2019s \u2018ok\u2019\u201d \u2013 &lt;&lt; yes &gt;&gt;\u2026 <a href=\"/a--b\" title=\"x--y\">a\u2013b</a></p>"},
+		{&SmartyOptions{Quotes: &GermanQuotes, EmDashes: true, Angled: true},
+			"<p>\u201eIt\u2019s \u201aok\u2018\u201c \u2014 \u00ab yes \u00bb\u2026 <a href=\"/a--b\" title=\"x--y\">a\u2014b</a></p>"},
+		{&SmartyOptions{Quotes: &FrenchQuotes, NoDashes: true, NoEllipses: true},
+			"<p>\u00ab\u202fIt\u2019s \u2039\u202fok\u202f\u203a\u202f\u00bb -- &lt;&lt; yes &gt;&gt;... <a href=\"/a--b\" title=\"x--y\">a--b</a></p>"},
+		{&SmartyOptions{NoQuotes: true},
+			"<p>&quot;It&#39;s &#39;ok&#39;&quot; \u2013 &lt;&lt; yes &gt;&gt;\u2026 <a href=\"/a--b\" title=\"x--y\">a\u2013b</a></p>"},
+	}
+	for _, c := range cases {
+		opts := DefaultOptions()
+		opts.Smartypants, opts.Smarty = true, c.smarty
+		if actual := New(input, opts).Render(); actual != c.expected {
+			t.Errorf("%+v: got\n%+v\nexpected\n%+v", c.smarty, actual, c.expected)
+		}
+	}
+}
+
+func TestFractions(t *testing.T) {
+	input := "1/2 and 81/100 cups, v1.1/2, go/1/2 [1/2](/1/2) `1/2` http://x.com/3/4"
+	cases := []struct {
+		mode     FractionsMode
+		fn       FractionFn
+		expected string
+	}{
+		{FractionsHTML, nil, "\u00bd and <sup>81</sup>&#8260;<sub>100</sub> cups"},
+		{FractionsUnicode, nil, "\u00bd and \u2078\u00b9\u2044\u2081\u2080\u2080 cups"},
+		{FractionsSlash, nil, "1\u20442 and 81\u2044100 cups"},
+		{FractionsHTML, func(num, den string) string {
+			return "<span class=\"frac\">" + num + "/" + den + "</span>"
+		}, "<span class=\"frac\">1/2</span> and <span class=\"frac\">81/100</span> cups"},
+	}
+	rest := ", v1.1/2, go/1/2 <a href=\"/1/2\">1/2</a> <code>1/2</code> <a href=\"http://x.com/3/4\">http://x.com/3/4</a></p>"
+	for _, c := range cases {
+		opts := DefaultOptions()
+		opts.Fractions, opts.FractionsMode, opts.FractionFn = true, c.mode, c.fn
+		expected := "<p>" + c.expected + rest
+		if actual := New(input, opts).Render(); actual != expected {
+			t.Errorf("mode %d: got\n%+v\nexpected\n%+v", c.mode, actual, expected)
+		}
+	}
+}
+
+func TestDocumentEdit(t *testing.T) {
+	input := "# title\n\nfoo\nbar\n\n- [ ] a\n- [x] b\n\n[baz][1]\n\n[1]: http://baz.com\n\n\tcode\n\nlast"
+	cases := []struct {
+		offset, oldLen int
+		text           string
+		start, removed int // changed nodes, -1 if not checked
+	}{
+		// Paragraph text
+		{13, 3, "BAR", 0, 2},
+		// Setext heading underline, joins the previous paragraph
+		{16, 1, "\n===\n", 0, 2},
+		// Open a fenced code block, that swallows the rest of the document
+		{0, 0, "```\n", 0, 8},
+		{0, 4, "", 0, 1},
+		// Task lists are re-indexed and moved
+		{30, 0, "- [ ] c\n", 2, 2},
+		// Link definitions re-parse the whole document
+		{58, 1, "2", 0, 8},
+		{1, 6, "\t", -1, -1},
+		{len(input), 0, "\n\n- [x] d", -1, -1},
+	}
+	d := NewDocument(input, nil)
+	d.Render()
+	for _, c := range cases {
+		input = input[:c.offset] + c.text + input[c.offset+c.oldLen:]
+		change, err := d.Edit(c.offset, c.oldLen, c.text)
+		if err != nil {
+			t.Fatalf("Edit(%d, %d, %q): %v", c.offset, c.oldLen, c.text, err)
+		}
+		if c.start != -1 && (change.Start != c.start || change.Removed != c.removed) {
+			t.Errorf("Edit(%d, %d, %q): got change [%d, +%d), expected [%d, +%d)", c.offset, c.oldLen, c.text,
+				change.Start, change.Removed, c.start, c.removed)
+		}
+		m := New(input, nil)
+		if actual, expected := d.Render(), m.Render(); actual != expected {
+			t.Errorf("Edit(%d, %d, %q): got\n%+v\nexpected\n%+v", c.offset, c.oldLen, c.text, actual, expected)
+		}
+		if actual, expected := positions(d.Nodes), positions(m.Nodes); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Edit(%d, %d, %q): got positions\n%v\nexpected\n%v", c.offset, c.oldLen, c.text, actual, expected)
+		}
+		tasks, expected := d.Tasks(), m.Tasks()
+		for i := range expected {
+			if i >= len(tasks) || tasks[i].Pos != expected[i].Pos || tasks[i].Index != i {
+				t.Errorf("Edit(%d, %d, %q): got task %d at a wrong position", c.offset, c.oldLen, c.text, i)
+			}
+		}
+		if len(tasks) != len(expected) {
+			t.Errorf("Edit(%d, %d, %q): got %d tasks, expected %d", c.offset, c.oldLen, c.text, len(tasks), len(expected))
+		}
+	}
+	if _, err := d.Edit(len(input), 1, ""); err == nil {
+		t.Error("Edit: expected an out of range error")
+	}
+	// The nested nodes are moved too
+	d = NewDocument("foo\n\n> bar\n\n- a\n- b", nil)
+	d.Render()
+	d.Edit(0, 0, "hello world\n\n")
+	if pos := d.Nodes[3].(*ListNode).Items[1].Pos; pos != 29 {
+		t.Errorf("Edit: got list item at %d, expected 29", pos)
+	}
+}
+
+// positions returns the positions of the nodes and their descendants.
+func positions(nodes []Node) (pos []Pos) {
+	for _, n := range nodes {
+		Walk(n, func(n Node) {
+			if n, ok := n.(interface{ position() Pos }); ok {
+				pos = append(pos, n.position())
+			}
+		})
+	}
+	return
+}
+
+func TestSourcePos(t *testing.T) {
+	cases := map[string]string{
+		"# foo\n\nbar\nbaz":          "<h1 id=\"foo\" data-sourcepos=\"1:1-1:5\">foo</h1>\n<p data-sourcepos=\"3:1-4:3\">bar\nbaz</p>",
+		"foo\n===\n\n\tcode":         "<h1 id=\"foo\" data-sourcepos=\"1:1-2:3\">foo</h1>\n<pre data-sourcepos=\"4:1-4:5\"><code>code</code></pre>",
+		"- a\n- b\n\n  c":            "<ul data-sourcepos=\"1:1-4:3\">\n<li data-sourcepos=\"1:1-1:3\">a</li>\n<li data-sourcepos=\"2:1-4:3\"><p data-sourcepos=\"2:3-2:3\">b</p><p data-sourcepos=\"4:3-4:3\">c</p></li>\n</ul>",
+		"> foo\n>\n> 1. bar":         "<blockquote data-sourcepos=\"1:1-3:8\"><p data-sourcepos=\"1:3-1:5\">foo</p><ol data-sourcepos=\"3:3-3:8\">\n<li data-sourcepos=\"3:3-3:8\">bar</li>\n</ol></blockquote>",
+		"```go\nfoo\n```":            "<pre data-sourcepos=\"1:1-3:3\"><code class=\"lang-go\">\nfoo\n</code></pre>",
+		"| a |\n|---|\n| b |\n\nfoo": "<table data-sourcepos=\"1:1-3:5\">\n<thead>\n<tr>\n<th>a</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>b</td>\n</tr>\n</tbody>\n</table>\n<p data-sourcepos=\"5:1-5:3\">foo</p>",
+	}
+	opts := DefaultOptions()
+	opts.SourcePos = true
+	for input, expected := range cases {
+		if actual := New(input, opts).Render(); actual != expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", input, actual, expected)
+		}
+	}
+	// The positions are updated by the document edits
+	input := "foo\n\n> bar\n\n- baz"
+	d := NewDocument(input, opts)
+	d.Render()
+	for _, edit := range []string{"\n\nfoo", "\t\t"} {
+		input = edit + input
+		d.Edit(0, 0, edit)
+		if actual, expected := d.Render(), New(input, opts).Render(); actual != expected {
+			t.Errorf("Edit(0, 0, %q): got\n%+v\nexpected\n%+v", edit, actual, expected)
+		}
+	}
+}
+
+func TestPosition(t *testing.T) {
+	m := New("# title\n\n> foo\n> - bar *baz*\n>\t[qux](/q)", nil)
+	m.Render()
+	var actual []string
+	for _, n := range m.Nodes {
+		Walk(n, func(n Node) {
+			switch n.Type() {
+			case NodeHeading, NodeBlockQuote, NodeListItem, NodeEmphasis, NodeLink:
+				line, col := m.Position(n)
+				actual = append(actual, fmt.Sprintf("%d:%d", line, col))
+			}
+		})
+	}
+	// The columns are counted in bytes of the original line
+	expected := []string{"1:1", "3:1", "4:3", "4:9", "5:3"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Position: got %v, expected %v", actual, expected)
+	}
+}
+
+func TestHeadingID(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AttributeLists = true
+	m := New("# Hello World!\n\n## foo {#bar}", opts)
+	m.Render()
+	for i, expected := range []string{"hello-world-", "bar"} {
+		if actual := m.Nodes[i].(*HeadingNode).ID(); actual != expected {
+			t.Errorf("Heading %d: got id %q, expected %q", i, actual, expected)
+		}
+	}
+}
+
+func TestRefNodeDef(t *testing.T) {
+	m := New("[foo][Bar] [baz]\n\n[bar]: http://bar.com", nil)
+	m.Render()
+	nodes := m.Nodes[0].(*ParagraphNode).Nodes
+	if def := nodes[0].(*RefNode).Def(); def == nil || def.Href != "http://bar.com" {
+		t.Errorf("Def: got %+v, expected the definition of [bar]", def)
+	}
+	if def := nodes[2].(*RefNode).Def(); def != nil {
+		t.Errorf("Def: got %+v, expected nil for an undefined reference", def)
+	}
+}
+
+func TestTypographer(t *testing.T) {
+	cases := map[string]string{
+		"(c) (C) (r) (tm) (TM) a -> b <- c +-1...":    "<p>\u00a9 \u00a9 \u00ae \u2122 \u2122 a \u2192 b \u2190 c \u00b11\u2026</p>",
+		"`(c) ->` [a->b](http://x.com/a->b \"(tm)\")": "<p><code>(c) -&gt;</code> <a href=\"http://x.com/a-&gt;b\" title=\"(tm)\">a\u2192b</a></p>",
+		"http://x.com/a->b":                           "<p><a href=\"http://x.com/a-&gt;b\">http://x.com/a-&gt;b</a></p>",
+		"    (c) -> b":                                "<pre><code>(c) -&gt; b</code></pre>",
+		"a --> b <-- c":                               "<p>a --&gt; b &lt;-- c</p>",
+		"## (c) 2020":                                 "<h2 id=\"-c-2020\">\u00a9 2020</h2>",
+	}
+	opts := DefaultOptions()
+	opts.Typographer = true
+	for input, expected := range cases {
+		if actual := New(input, opts).Render(); actual != expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", input, actual, expected)
+		}
+	}
+}
+
+func TestXHTML(t *testing.T) {
+	cases := map[string]string{
+		"foo  \nbar":                      "<p>foo<br />bar</p>",
+		"foo\n***":                        "<p>foo</p>\n<hr />",
+		"![a \"b\" & c](/x.png \"it's\")": "<p><img src=\"/x.png\" alt=\"a &quot;b&quot; &amp; c\" title=\"it&#39;s\" /></p>",
+		"- [x] foo\n- [ ] bar":            "<ul>\n<li><input type=\"checkbox\" checked=\"checked\" disabled=\"disabled\" data-task=\"0\" />foo</li>\n<li><input type=\"checkbox\" disabled=\"disabled\" data-task=\"1\" />bar</li>\n</ul>",
+		"81/100":                          "<p><sup>81</sup>&#8260;<sub>100</sub></p>",
+	}
+	opts := DefaultOptions()
+	opts.XHTML = true
+	opts.Fractions = true
+	for input, expected := range cases {
+		if actual := New(input, opts).Render(); actual != expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", input, actual, expected)
+		}
+	}
+}
+
+func TestTableAlign(t *testing.T) {
+	input := "a | b | c\n:-|:-:|--"
+	row := "<tr>\n<th%s>a</th>\n<th%s>b</th>\n<th>c</th>\n</tr>"
+	cases := map[AlignMode][2]string{
+		AlignStyle: {` style="text-align:left"`, ` style="text-align:center"`},
+		AlignClass: {` class="align-left"`, ` class="align-center"`},
+		AlignAttr:  {` align="left"`, ` align="center"`},
+		AlignNone:  {"", ""},
+	}
+	for mode, attrs := range cases {
+		opts := DefaultOptions()
+		opts.TableAlign = mode
+		expected := "<table>\n<thead>\n" + fmt.Sprintf(row, attrs[0], attrs[1]) + "\n</thead>\n</table>"
+		if actual := New(input, opts).Render(); actual != expected {
+			t.Errorf("mode %d: got\n%+v\nexpected\n%+v", mode, actual, expected)
+		}
+	}
+}
+
+// ContainerNode is a custom node, used to test block rules.
+type ContainerNode struct {
+	NodeType
+	Pos
+	Kind  string
+	Nodes []Node
+}
+
+func (n *ContainerNode) Render() (s string) {
+	for _, node := range n.Nodes {
+		s += node.Render()
+	}
+	return "<div class=\"" + n.Kind + "\">" + s + "</div>"
+}
+
+const NodeContainer NodeType = 101
+
+func TestBlockRule(t *testing.T) {
+	reContainer := regexp.MustCompile(`(?s)^:::(\w+)\n(.*?)(?:\n:::(?:\n|$)|$)`)
+	container := &BlockRule{
+		Start: func(s string) bool {
+			return strings.HasPrefix(s, ":::")
+		},
+		Scan: func(s string) int {
+			return len(reContainer.FindString(s))
+		},
+		Node: func(src string, parse func(string) []Node) Node {
+			m := reContainer.FindStringSubmatch(src)
+			return &ContainerNode{NodeType: NodeContainer, Kind: m[1], Nodes: parse(m[2])}
+		},
+	}
+	cases := map[string]string{
+		":::note\nhello __world__\n:::\nfoo":  "<div class=\"note\"><p>hello <strong>world</strong></p></div>\n<p>foo</p>",
+		"> :::tip\n> - [a]\n> :::\n\n[a]: /a": "<blockquote><div class=\"tip\"><ul>\n<li><a href=\"/a\">a</a></li>\n</ul></div></blockquote>",
+		"foo\n::: bar":                        "<p>foo\n::: bar</p>",
+	}
+	for input, expected := range cases {
+		m := New(input, nil)
+		m.AddBlockRule(container)
+		if actual := m.Render(); actual != expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", input, actual, expected)
+		}
+	}
+	// A rule that starts like another one(the math blocks), but isn't scanned by it
+	include := &BlockRule{
+		Start: func(s string) bool {
+			return strings.HasPrefix(s, "$$include ")
+		},
+		Scan: func(s string) int {
+			return len(reList.scanLine(s))
+		},
+		Node: func(src string, _ func(string) []Node) Node {
+			return &ContainerNode{NodeType: NodeContainer, Kind: "include"}
+		},
+	}
+	opts := DefaultOptions()
+	opts.Math = true
+	m := New("$$include foo.md\n\nbar", opts)
+	m.AddBlockRule(include)
+	expected := "<div class=\"include\"></div>\n<p>bar</p>"
+	if actual := m.Render(); actual != expected {
+		t.Errorf("Block rules: got\n%+v\nexpected\n%+v", actual, expected)
+	}
+	// A rule that scans a line only if it's terminated, can't scan its block alone
+	line := &BlockRule{
+		Start: func(s string) bool {
+			return strings.HasPrefix(s, "@@")
+		},
+		Scan: func(s string) int {
+			if i := strings.Index(s, "\n"); i > 0 {
+				return i
+			}
+			return 0
+		},
+		Node: func(src string, _ func(string) []Node) Node {
+			return &ContainerNode{NodeType: NodeContainer, Kind: src[2:]}
+		},
+	}
+	m = New("@@line\nbar", nil)
+	m.AddBlockRule(line)
+	expected = "<div class=\"line\"></div>\n<p>bar</p>"
+	if actual := m.Render(); actual != expected {
+		t.Errorf("Block rules: got\n%+v\nexpected\n%+v", actual, expected)
+	}
+}
+
 type CommonMarkSpec struct {
 	name     string
 	input    string
@@ -1411,7 +2136,7 @@ bar</p>`},
 	{"418", "_*foo*_", "<p><em><em>foo</em></em></p>"},
 	{"419", "****foo****", "<p><strong><strong>foo</strong></strong></p>"},
 	{"420", "____foo____", "<p><strong><strong>foo</strong></strong></p>"},
-	{"422", "***foo***", "<p><strong><em>foo</em></strong></p>"},
+	{"422", "***foo***", "<p><em><strong>foo</strong></em></p>"},
 	{"424", "*foo _bar* baz_", "<p><em>foo _bar</em> baz_</p>"},
 	{"438", "[link](/uri \"title\")", "<p><a href=\"/uri\" title=\"title\">link</a></p>"},
 	{"439", "[link](/uri)", "<p><a href=\"/uri\">link</a></p>"},
@@ -1439,6 +2164,8 @@ bar</p>`},
 	{"463", "[link [bar](/uri)", `<p>[link <a href="/uri">bar</a></p>`},
 	{"471", "[foo *bar](baz*)", `<p><a href="baz*">foo *bar</a></p>`},
 	{"472", "*foo [bar* baz]", "<p><em>foo [bar</em> baz]</p>"},
+	// The same, with a defined reference
+	{"472", "*foo [bar*][r]\n\n[r]: /u", "<p>*foo <a href=\"/u\">bar*</a></p>"},
 	{"476", `
 [foo][bar]
 
@@ -2,7 +2,9 @@ package mark
 
 import (
 	"fmt"
+	"html"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -22,9 +24,118 @@ func (t NodeType) Type() NodeType {
 	return t
 }
 
+// Walk calls fn for the given node and for its descendants, in document order.
+// The children of nodes that are created by custom rules are not visited.
+func Walk(n Node, fn func(Node)) {
+	fn(n)
+	var nodes []Node
+	switch n := n.(type) {
+	case *ParagraphNode:
+		nodes = n.Nodes
+	case *EmphasisNode:
+		nodes = n.Nodes
+	case *HeadingNode:
+		nodes = n.Nodes
+	case *LinkNode:
+		nodes = n.Nodes
+	case *RefNode:
+		nodes = n.Nodes
+	case *BlockQuoteNode:
+		nodes = n.Nodes
+	case *AlertNode:
+		nodes = n.Nodes
+	case *ListNode:
+		for _, item := range n.Items {
+			nodes = append(nodes, item)
+		}
+	case *ListItemNode:
+		nodes = n.Nodes
+	case *TableNode:
+		nodes = n.Caption
+		for _, row := range append(append([]*RowNode{}, n.Header...), n.Body...) {
+			nodes = append(nodes, row)
+		}
+	case *RowNode:
+		for _, cell := range n.Cells {
+			nodes = append(nodes, cell)
+		}
+	case *CellNode:
+		nodes = n.Nodes
+	}
+	for _, node := range nodes {
+		Walk(node, fn)
+	}
+}
+
 // Render function, used for overriding default rendering.
 type RenderFn func(Node) string
 
+// Diagram function, used for rendering fenced code blocks of a specific
+// language(e.g: mermaid, dot, plantuml). It gets the raw source of the block,
+// and returns its html representation. If it fails, the block is rendered
+// as a regular code block.
+type DiagramFn func(src string) (string, error)
+
+// Attributes function, used for adding attributes to the rendered elements
+// (e.g: rel and target on links, or classes on tables).
+// It gets a node, and returns the attributes to merge into its tag, or nil.
+type AttributesFn func(node Node) map[string]string
+
+// Inline rule function, used for extending the inline syntax.
+// It gets the input that starts with the rule trigger, and returns the
+// length of the matched text and the node that represents it, or 0 if
+// the input doesn't match.
+type InlineFn func(string) (int, Node)
+
+// BlockRule describes a custom block construct.
+type BlockRule struct {
+	// Start reports whether the input(at the beginning of a line) starts the block.
+	Start func(input string) bool
+	// Scan returns the length of the block source, or 0 if it's not a block.
+	Scan func(input string) int
+	// Node returns the node that represents the block source.
+	// parse can be used to parse a nested markdown content(e.g: container body).
+	Node func(src string, parse func(string) []Node) Node
+}
+
+// renderer renders nested nodes using the custom render functions.
+// Embedded in all Nodes that have children.
+type renderer struct {
+	fns   map[NodeType]RenderFn
+	attrs *[]AttributesFn
+}
+
+// render renders the given node with its custom render function if
+// exists, or with its default Render method otherwise.
+// The attributes of the node are merged into the default rendering.
+func (r renderer) render(n Node) string {
+	if fn, ok := r.fns[n.Type()]; ok {
+		return fn(n)
+	}
+	s := n.Render()
+	if r.attrs == nil || n.Type() == NodeText || n.Type() == NodeHTML {
+		return s
+	}
+	for _, fn := range *r.attrs {
+		s = mergeAttrs(s, fn(n))
+	}
+	return s
+}
+
+// renderAll renders and concatenates the given nodes.
+func (r renderer) renderAll(nodes []Node) (s string) {
+	for _, node := range nodes {
+		s += r.render(node)
+	}
+	return
+}
+
+// renderer returns the renderer of the parse tree.
+func (p *parse) renderer() renderer {
+	root := p.root()
+	return renderer{root.renderFn, &root.attrs}
+}
+
 const (
 	NodeText       NodeType = iota // A plain text
 	NodeParagraph                  // A Paragraph
@@ -46,6 +157,9 @@ const (
 	NodeBlockQuote                 // A blockquote
 	NodeHTML                       // An inline HTML
 	NodeCheckbox                   // A checkbox
+	NodeAlert                      // A GitHub-style alert(blockquote)
+	NodeEmoji                      // An emoji shortcode
+	NodeMath                       // A math expression(inline or display)
 )
 
 // ParagraphNode hold simple paragraph node contains text
@@ -53,19 +167,17 @@ const (
 type ParagraphNode struct {
 	NodeType
 	Pos
+	renderer
 	Nodes []Node
 }
 
 // Render returns the html representation of ParagraphNode
 func (n *ParagraphNode) Render() (s string) {
-	for _, node := range n.Nodes {
-		s += node.Render()
-	}
-	return wrap("p", s)
+	return wrap("p", n.renderAll(n.Nodes))
 }
 
 func (p *parse) newParagraph(pos Pos) *ParagraphNode {
-	return &ParagraphNode{NodeType: NodeParagraph, Pos: pos}
+	return &ParagraphNode{NodeType: NodeParagraph, Pos: p.source(pos), renderer: p.renderer()}
 }
 
 // TextNode holds plain text.
@@ -75,13 +187,13 @@ type TextNode struct {
 	Text string
 }
 
-// Render returns the string representation of TexNode
+// Render returns the html representation of TexNode
 func (n *TextNode) Render() string {
-	return n.Text
+	return escape(n.Text)
 }
 
 func (p *parse) newText(pos Pos, text string) *TextNode {
-	return &TextNode{NodeType: NodeText, Pos: pos, Text: p.text(text)}
+	return &TextNode{NodeType: NodeText, Pos: p.source(pos), Text: p.text(text)}
 }
 
 // HTMLNode holds the raw html source.
@@ -97,37 +209,39 @@ func (n *HTMLNode) Render() string {
 }
 
 func (p *parse) newHTML(pos Pos, src string) *HTMLNode {
-	return &HTMLNode{NodeType: NodeHTML, Pos: pos, Src: src}
+	return &HTMLNode{NodeType: NodeHTML, Pos: p.source(pos), Src: src}
 }
 
 // HrNode represents horizontal rule
 type HrNode struct {
 	NodeType
 	Pos
+	xhtml bool
 }
 
 // Render returns the html representation of hr.
 func (n *HrNode) Render() string {
-	return "<hr>"
+	return "<hr" + closeVoid(n.xhtml)
 }
 
 func (p *parse) newHr(pos Pos) *HrNode {
-	return &HrNode{NodeType: NodeHr, Pos: pos}
+	return &HrNode{NodeType: NodeHr, Pos: p.source(pos), xhtml: p.root().options.XHTML}
 }
 
 // BrNode represents a link-break element.
 type BrNode struct {
 	NodeType
 	Pos
+	xhtml bool
 }
 
 // Render returns the html representation of line-break.
 func (n *BrNode) Render() string {
-	return "<br>"
+	return "<br" + closeVoid(n.xhtml)
 }
 
 func (p *parse) newBr(pos Pos) *BrNode {
-	return &BrNode{NodeType: NodeBr, Pos: pos}
+	return &BrNode{NodeType: NodeBr, Pos: p.source(pos), xhtml: p.root().options.XHTML}
 }
 
 // EmphasisNode holds plain-text wrapped with style.
@@ -135,6 +249,7 @@ func (p *parse) newBr(pos Pos) *BrNode {
 type EmphasisNode struct {
 	NodeType
 	Pos
+	renderer
 	Style itemType
 	Nodes []Node
 }
@@ -156,87 +271,107 @@ func (n *EmphasisNode) Tag() (s string) {
 
 // Return the html representation of emphasis text.
 func (n *EmphasisNode) Render() string {
-	var s string
-	for _, node := range n.Nodes {
-		s += node.Render()
-	}
-	return wrap(n.Tag(), s)
+	return wrap(n.Tag(), n.renderAll(n.Nodes))
 }
 
 func (p *parse) newEmphasis(pos Pos, style itemType) *EmphasisNode {
-	return &EmphasisNode{NodeType: NodeEmphasis, Pos: pos, Style: style}
+	return &EmphasisNode{NodeType: NodeEmphasis, Pos: p.source(pos), renderer: p.renderer(), Style: style}
 }
 
 // HeadingNode holds heaing element with specific level(1-6).
 type HeadingNode struct {
 	NodeType
 	Pos
+	renderer
 	Level int
 	Text  string
 	Nodes []Node
+	Attrs map[string]string
+	plain string // the text before the typographic replacements, used by ID
 }
 
 // Render returns the html representation based on heading level.
 func (n *HeadingNode) Render() (s string) {
-	for _, node := range n.Nodes {
-		s += node.Render()
+	s = n.renderAll(n.Nodes)
+	s = fmt.Sprintf("<%[1]s id=\"%s\">%s</%[1]s>", "h"+strconv.Itoa(n.Level), escape(n.ID()), s)
+	return mergeAttrs(s, n.Attrs)
+}
+
+// ID returns the id of the heading element, generated from its text,
+// or set with an attribute list. i.e: the target of "#id" links.
+func (n *HeadingNode) ID() string {
+	if id, ok := n.Attrs["id"]; ok {
+		return id
 	}
 	re := regexp.MustCompile(`[^\w]+`)
-	id := re.ReplaceAllString(n.Text, "-")
+	text := n.plain
+	if text == "" {
+		text = n.Text
+	}
+	id := re.ReplaceAllString(text, "-")
 	// ToLowerCase
-	id = strings.ToLower(id)
-	return fmt.Sprintf("<%[1]s id=\"%s\">%s</%[1]s>", "h"+strconv.Itoa(n.Level), id, s)
+	return strings.ToLower(id)
 }
 
 func (p *parse) newHeading(pos Pos, level int, text string) *HeadingNode {
-	return &HeadingNode{NodeType: NodeHeading, Pos: pos, Level: level, Text: p.text(text)}
+	return &HeadingNode{NodeType: NodeHeading, Pos: p.source(pos), renderer: p.renderer(), Level: level, Text: p.text(text),
+		plain: unescape(text)}
 }
 
 // Code holds CodeBlock node with specific lang field.
 type CodeNode struct {
 	NodeType
 	Pos
-	Lang, Text string
+	Lang, Text string // Text is HTML-escaped
+	Attrs      map[string]string
+	src        string // the raw code, passed to the diagram hooks
+	diagrams   map[string]DiagramFn
 }
 
 // Return the html representation of codeBlock
 func (n *CodeNode) Render() string {
+	// Diagram blocks(e.g: mermaid, dot) are rendered by their hooks
+	if fn, ok := n.diagrams[n.Lang]; ok {
+		if s, err := fn(n.src); err == nil {
+			return s
+		}
+	}
 	var attr string
 	if n.Lang != "" {
 		attr = fmt.Sprintf(" class=\"lang-%s\"", n.Lang)
 	}
 	code := fmt.Sprintf("<%[1]s%s>%s</%[1]s>", "code", attr, n.Text)
-	return wrap("pre", code)
+	return mergeAttrs(wrap("pre", code), n.Attrs)
 }
 
 func (p *parse) newCode(pos Pos, lang, text string) *CodeNode {
 	// DRY: see `escape()` below
-	text = strings.NewReplacer("<", "&lt;", ">", "&gt;", "\"", "&quot;", "&", "&amp;").Replace(text)
-	return &CodeNode{NodeType: NodeCode, Pos: pos, Lang: lang, Text: text}
+	escaped := strings.NewReplacer("<", "&lt;", ">", "&gt;", "\"", "&quot;", "&", "&amp;").Replace(text)
+	return &CodeNode{NodeType: NodeCode, Pos: p.source(pos), Lang: lang, Text: escaped, src: text, diagrams: p.root().diagrams}
 }
 
 // Link holds a tag with optional title
 type LinkNode struct {
 	NodeType
 	Pos
+	renderer
 	Title, Href string
 	Nodes       []Node
+	Attrs       map[string]string
 }
 
 // Return the html representation of link node
 func (n *LinkNode) Render() (s string) {
-	for _, node := range n.Nodes {
-		s += node.Render()
-	}
-	attrs := fmt.Sprintf("href=\"%s\"", n.Href)
+	s = n.renderAll(n.Nodes)
+	attrs := fmt.Sprintf("href=\"%s\"", escape(n.Href))
 	if n.Title != "" {
-		attrs += fmt.Sprintf(" title=\"%s\"", n.Title)
+		attrs += fmt.Sprintf(" title=\"%s\"", escape(n.Title))
 	}
-	return fmt.Sprintf("<a %s>%s</a>", attrs, s)
+	return mergeAttrs(fmt.Sprintf("<a %s>%s</a>", attrs, s), n.Attrs)
 }
 
 func (p *parse) newLink(pos Pos, title, href string, nodes ...Node) *LinkNode {
-	return &LinkNode{NodeType: NodeLink, Pos: pos, Title: p.text(title), Href: p.text(href), Nodes: nodes}
+	return &LinkNode{NodeType: NodeLink, Pos: p.source(pos), renderer: p.renderer(), Title: unescape(title), Href: unescape(href), Nodes: nodes}
 }
 
 // RefLink holds link with refrence to link definition
@@ -251,8 +386,7 @@ type RefNode struct {
 // rendering based type
 func (n *RefNode) Render() string {
 	var node Node
-	ref := strings.ToLower(n.Ref)
-	if l, ok := n.tr.links[ref]; ok {
+	if l := n.Def(); l != nil {
 		if n.Type() == NodeRefLink {
 			node = n.tr.newLink(n.Pos, l.Title, l.Href, n.Nodes...)
 		} else {
@@ -261,17 +395,22 @@ func (n *RefNode) Render() string {
 	} else {
 		node = n.tr.newText(n.Pos, n.Raw)
 	}
-	return node.Render()
+	return n.tr.renderer().render(node)
+}
+
+// Def returns the link definition of the reference, or nil if it's undefined.
+func (n *RefNode) Def() *DefLinkNode {
+	return n.tr.links[strings.ToLower(n.Ref)]
 }
 
 // newRefLink create new RefLink that suitable for link
 func (p *parse) newRefLink(typ itemType, pos Pos, raw, ref string, text []Node) *RefNode {
-	return &RefNode{NodeType: NodeRefLink, Pos: pos, tr: p.root(), Raw: raw, Ref: ref, Nodes: text}
+	return &RefNode{NodeType: NodeRefLink, Pos: p.source(pos), tr: p.root(), Raw: raw, Ref: ref, Nodes: text}
 }
 
 // newRefImage create new RefLink that suitable for image
 func (p *parse) newRefImage(typ itemType, pos Pos, raw, ref, text string) *RefNode {
-	return &RefNode{NodeType: NodeRefImage, Pos: pos, tr: p.root(), Raw: raw, Ref: ref, Text: text}
+	return &RefNode{NodeType: NodeRefImage, Pos: p.source(pos), tr: p.root(), Raw: raw, Ref: ref, Text: text}
 }
 
 // DefLinkNode refresent single reference to link-definition
@@ -287,7 +426,7 @@ func (n *DefLinkNode) Render() string {
 }
 
 func (p *parse) newDefLink(pos Pos, name, href, title string) *DefLinkNode {
-	return &DefLinkNode{NodeType: NodeLink, Pos: pos, Name: name, Href: href, Title: title}
+	return &DefLinkNode{NodeType: NodeDefLink, Pos: p.source(pos), Name: name, Href: href, Title: title}
 }
 
 // ImageNode represents an image element with optional alt and title attributes.
@@ -295,27 +434,35 @@ type ImageNode struct {
 	NodeType
 	Pos
 	Title, Src, Alt string
+	Attrs           map[string]string
+	xhtml           bool
 }
 
 // Render returns the html representation on image node
 func (n *ImageNode) Render() string {
-	attrs := fmt.Sprintf("src=\"%s\" alt=\"%s\"", n.Src, n.Alt)
+	attrs := fmt.Sprintf("src=\"%s\" alt=\"%s\"", escape(n.Src), escape(n.Alt))
 	if n.Title != "" {
-		attrs += fmt.Sprintf(" title=\"%s\"", n.Title)
+		attrs += fmt.Sprintf(" title=\"%s\"", escape(n.Title))
 	}
-	return fmt.Sprintf("<img %s>", attrs)
+	return mergeAttrs("<img "+attrs+closeVoid(n.xhtml), n.Attrs)
 }
 
 func (p *parse) newImage(pos Pos, title, src, alt string) *ImageNode {
-	return &ImageNode{NodeType: NodeImage, Pos: pos, Title: p.text(title), Src: p.text(src), Alt: p.text(alt)}
+	return &ImageNode{NodeType: NodeImage, Pos: p.source(pos), Title: unescape(title), Src: unescape(src), Alt: p.text(alt),
+		xhtml: p.root().options.XHTML}
 }
 
 // ListNode holds list items nodes in ordered or unordered states.
 type ListNode struct {
 	NodeType
 	Pos
-	Ordered bool
-	Items   []*ListItemNode
+	renderer
+	Ordered    bool
+	Start      int  // start number of an ordered list
+	Delimiter  rune // '.' or ')' in ordered lists
+	BulletChar rune // '*', '+' or '-' in unordered lists
+	Tight      bool // no item is wrapped with a paragraph
+	Items      []*ListItemNode
 }
 
 func (n *ListNode) append(item *ListItemNode) {
@@ -329,20 +476,24 @@ func (n *ListNode) Render() (s string) {
 		tag = "ol"
 	}
 	for _, item := range n.Items {
-		s += "\n" + item.Render()
+		s += "\n" + n.render(item)
 	}
 	s += "\n"
+	if n.Ordered && n.Start != 1 {
+		return fmt.Sprintf("<%[1]s start=\"%d\">%s</%[1]s>", tag, n.Start, s)
+	}
 	return wrap(tag, s)
 }
 
 func (p *parse) newList(pos Pos, ordered bool) *ListNode {
-	return &ListNode{NodeType: NodeList, Pos: pos, Ordered: ordered}
+	return &ListNode{NodeType: NodeList, Pos: p.source(pos), renderer: p.renderer(), Ordered: ordered}
 }
 
 // ListItem represents single item in ListNode that may contains nested nodes.
 type ListItemNode struct {
 	NodeType
 	Pos
+	renderer
 	Nodes []Node
 }
 
@@ -352,54 +503,66 @@ func (l *ListItemNode) append(n Node) {
 
 // Render returns the html representation of list-item
 func (l *ListItemNode) Render() (s string) {
-	for _, node := range l.Nodes {
-		s += node.Render()
-	}
-	return wrap("li", s)
+	return wrap("li", l.renderAll(l.Nodes))
 }
 
 func (p *parse) newListItem(pos Pos) *ListItemNode {
-	return &ListItemNode{NodeType: NodeListItem, Pos: pos}
+	return &ListItemNode{NodeType: NodeListItem, Pos: p.source(pos), renderer: p.renderer()}
 }
 
 // TableNode represents table element contains head and body
 type TableNode struct {
 	NodeType
 	Pos
+	renderer
+	Header  []*RowNode // thead rows
+	Body    []*RowNode // tbody rows
+	Align   []AlignType
+	Caption []Node
+	// Deprecated: Rows holds the Header rows followed by the Body rows, and
+	// it's not used in rendering. Use Header and Body instead.
 	Rows []*RowNode
 }
 
 func (n *TableNode) append(row *RowNode) {
-	n.Rows = append(n.Rows, row)
+	n.Body = append(n.Body, row)
+}
+
+// setRows fills the deprecated Rows field.
+func (n *TableNode) setRows() {
+	n.Rows = append(append([]*RowNode{}, n.Header...), n.Body...)
 }
 
 // Render returns the html representation of a table
 func (n *TableNode) Render() string {
 	var s string
-	for i, row := range n.Rows {
-		s += "\n"
-		switch i {
-		case 0:
-			s += wrap("thead", "\n"+row.Render()+"\n")
-		case 1:
-			s += "<tbody>\n"
-			fallthrough
-		default:
-			s += row.Render()
+	if n.Caption != nil {
+		s += "\n" + wrap("caption", n.renderAll(n.Caption))
+	}
+	var head string
+	for _, row := range n.Header {
+		head += "\n" + n.render(row)
+	}
+	s += "\n" + wrap("thead", head+"\n")
+	if len(n.Body) > 0 {
+		s += "\n<tbody>"
+		for _, row := range n.Body {
+			s += "\n" + n.render(row)
 		}
+		s += "\n</tbody>"
 	}
-	s += "\n</tbody>\n"
-	return wrap("table", s)
+	return wrap("table", s+"\n")
 }
 
 func (p *parse) newTable(pos Pos) *TableNode {
-	return &TableNode{NodeType: NodeTable, Pos: pos}
+	return &TableNode{NodeType: NodeTable, Pos: p.source(pos), renderer: p.renderer()}
 }
 
 // RowNode represnt tr that holds list of cell-nodes
 type RowNode struct {
 	NodeType
 	Pos
+	renderer
 	Cells []*CellNode
 }
 
@@ -411,14 +574,14 @@ func (r *RowNode) append(cell *CellNode) {
 func (r *RowNode) Render() string {
 	var s string
 	for _, cell := range r.Cells {
-		s += "\n" + cell.Render()
+		s += "\n" + r.render(cell)
 	}
 	s += "\n"
 	return wrap("tr", s)
 }
 
 func (p *parse) newRow(pos Pos) *RowNode {
-	return &RowNode{NodeType: NodeRow, Pos: pos}
+	return &RowNode{NodeType: NodeRow, Pos: p.source(pos), renderer: p.renderer()}
 }
 
 // AlignType identifies the aligment-type of specfic cell.
@@ -438,6 +601,17 @@ const (
 	Center
 )
 
+// AlignMode identifies how the alignment of table cells is rendered.
+type AlignMode int
+
+// Alignment rendering modes
+const (
+	AlignStyle AlignMode = iota // style="text-align:center"
+	AlignClass                  // class="align-center"
+	AlignAttr                   // align="center"
+	AlignNone                   // no alignment attribute
+)
+
 // Cell types
 const (
 	Header = iota
@@ -450,8 +624,11 @@ type CellNode struct {
 	NodeType
 	Pos
 	AlignType
-	Kind  int
-	Nodes []Node
+	renderer
+	Kind    int
+	Colspan int
+	Nodes   []Node
+	mode    AlignMode
 }
 
 // Render returns the html reprenestation of table-cell
@@ -461,10 +638,36 @@ func (c *CellNode) Render() string {
 	if c.Kind == Header {
 		tag = "th"
 	}
-	for _, node := range c.Nodes {
-		s += node.Render()
+	s = c.renderAll(c.Nodes)
+	var span string
+	if c.Colspan > 1 {
+		span = fmt.Sprintf(" colspan=\"%d\"", c.Colspan)
 	}
-	return fmt.Sprintf("<%[1]s%s>%s</%[1]s>", tag, c.Style(), s)
+	return fmt.Sprintf("<%[1]s%s%s>%s</%[1]s>", tag, span, c.alignAttr(), s)
+}
+
+// alignAttr returns the alignment attribute based on the rendering mode
+func (c *CellNode) alignAttr() string {
+	var align string
+	switch c.Align() {
+	case Right:
+		align = "right"
+	case Left:
+		align = "left"
+	case Center:
+		align = "center"
+	default:
+		return ""
+	}
+	switch c.mode {
+	case AlignClass:
+		return fmt.Sprintf(" class=\"align-%s\"", align)
+	case AlignAttr:
+		return fmt.Sprintf(" align=\"%s\"", align)
+	case AlignNone:
+		return ""
+	}
+	return c.Style()
 }
 
 // Style return the cell-style based on alignment field
@@ -484,48 +687,175 @@ func (c *CellNode) Style() string {
 }
 
 func (p *parse) newCell(pos Pos, kind int, align AlignType) *CellNode {
-	return &CellNode{NodeType: NodeCell, Pos: pos, Kind: kind, AlignType: align}
+	return &CellNode{NodeType: NodeCell, Pos: p.source(pos), renderer: p.renderer(), Kind: kind, Colspan: 1, AlignType: align,
+		mode: p.root().options.TableAlign}
 }
 
 // BlockQuote represents block-quote tag.
 type BlockQuoteNode struct {
 	NodeType
 	Pos
+	renderer
 	Nodes []Node
 }
 
 // Render returns the html representation of BlockQuote
 func (n *BlockQuoteNode) Render() string {
-	var s string
-	for _, node := range n.Nodes {
-		s += node.Render()
-	}
-	return wrap("blockquote", s)
+	return wrap("blockquote", n.renderAll(n.Nodes))
 }
 
 func (p *parse) newBlockQuote(pos Pos) *BlockQuoteNode {
-	return &BlockQuoteNode{NodeType: NodeBlockQuote, Pos: pos}
+	return &BlockQuoteNode{NodeType: NodeBlockQuote, Pos: p.source(pos), renderer: p.renderer()}
+}
+
+// AlertNode represents a GitHub-style alert, a blockquote
+// that starts with a marker line like: `[!NOTE]`.
+type AlertNode struct {
+	NodeType
+	Pos
+	renderer
+	Kind  string // note, tip, important, warning or caution
+	Nodes []Node
+}
+
+// Title returns the title of the alert, based on its kind.
+func (n *AlertNode) Title() string {
+	return strings.ToUpper(n.Kind[:1]) + n.Kind[1:]
+}
+
+// Render returns the html representation of an alert.
+func (n *AlertNode) Render() string {
+	title := fmt.Sprintf("<p class=\"markdown-alert-title\">%s</p>", n.Title())
+	return fmt.Sprintf("<div class=\"markdown-alert markdown-alert-%s\">%s%s</div>", n.Kind, title, n.renderAll(n.Nodes))
+}
+
+func (p *parse) newAlert(pos Pos, kind string) *AlertNode {
+	return &AlertNode{NodeType: NodeAlert, Pos: p.source(pos), renderer: p.renderer(), Kind: kind}
+}
+
+// EmojiNode represents an emoji shortcode(e.g: `:tada:`).
+// Use AddRenderFn with NodeEmoji to render it as an image.
+type EmojiNode struct {
+	NodeType
+	Pos
+	Name, Glyph string
+}
+
+// Render returns the unicode glyph of the emoji.
+func (n *EmojiNode) Render() string {
+	return n.Glyph
+}
+
+func (p *parse) newEmoji(name, glyph string) *EmojiNode {
+	return &EmojiNode{NodeType: NodeEmoji, Name: name, Glyph: glyph}
+}
+
+// MathNode holds a TeX math expression, rendered for KaTeX/MathJax.
+// Display math that is part of a paragraph(e.g: `foo $$x$$ bar`) is
+// rendered as a span with a "display" class.
+type MathNode struct {
+	NodeType
+	Pos
+	Display bool
+	Block   bool
+	Text    string
+}
+
+// Render returns the html representation of inline(span) or display(div) math.
+func (n *MathNode) Render() string {
+	tag, class := "span", "math"
+	if n.Block {
+		tag = "div"
+	} else if n.Display {
+		class += " display"
+	}
+	return fmt.Sprintf("<%[1]s class=\"%s\">%s</%[1]s>", tag, class, escape(n.Text))
+}
+
+func (p *parse) newMath(pos Pos, text string, display, block bool) *MathNode {
+	return &MathNode{NodeType: NodeMath, Pos: p.source(pos), Display: display, Block: block, Text: text}
 }
 
 // CheckboxNode represents checked and unchecked checkbox tag.
-// Used in task lists.
+// Used in task lists. Pos is the offset of the checkbox(`[ ]`) in the
+// input, and Index is its position among the task lists checkboxes.
 type CheckboxNode struct {
 	NodeType
 	Pos
 	Checked bool
+	Index   int
+	xhtml   bool
 }
 
 // Render returns the html representation of checked and unchecked CheckBox.
+// The checkbox is disabled, and its data-task attribute holds its Index.
 func (n *CheckboxNode) Render() string {
 	s := "<input type=\"checkbox\""
-	if n.Checked {
+	if n.Checked && n.xhtml {
+		s += " checked=\"checked\""
+	} else if n.Checked {
 		s += " checked"
 	}
-	return s + ">"
+	if n.xhtml {
+		s += " disabled=\"disabled\""
+	} else {
+		s += " disabled"
+	}
+	s += fmt.Sprintf(" data-task=\"%d\"", n.Index)
+	return s + closeVoid(n.xhtml)
 }
 
 func (p *parse) newCheckbox(pos Pos, checked bool) *CheckboxNode {
-	return &CheckboxNode{NodeType: NodeCheckbox, Pos: pos, Checked: checked}
+	root := p.root()
+	n := &CheckboxNode{NodeType: NodeCheckbox, Pos: p.source(pos), Checked: checked, Index: len(root.tasks), xhtml: root.options.XHTML}
+	root.tasks = append(root.tasks, n)
+	return n
+}
+
+// closeVoid returns the end of a void element(e.g: br, hr), based on the output dialect.
+func closeVoid(xhtml bool) string {
+	if xhtml {
+		return " />"
+	}
+	return ">"
+}
+
+// mergeAttrs merges the given attributes into the first tag of s.
+// Classes and styles are appended to the existing ones, and the other
+// attributes override the existing values.
+func mergeAttrs(s string, attrs map[string]string) string {
+	m := reOpenTag.tag.FindStringSubmatch(s)
+	if m == nil || len(attrs) == 0 {
+		return s
+	}
+	rest := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		rest[k] = v
+	}
+	tag := "<" + m[1]
+	for _, a := range reOpenTag.attr.FindAllStringSubmatch(m[2], -1) {
+		v, ok := attrs[a[1]]
+		switch {
+		case !ok:
+			tag += a[0]
+		case a[1] == "class" && a[2] != "":
+			tag += fmt.Sprintf(" class=\"%s %s\"", a[2], escape(v))
+		case a[1] == "style" && a[2] != "":
+			tag += fmt.Sprintf(" style=\"%s;%s\"", strings.TrimSuffix(a[2], ";"), escape(v))
+		default:
+			tag += fmt.Sprintf(" %s=\"%s\"", a[1], escape(v))
+		}
+		delete(rest, a[1])
+	}
+	var keys []string
+	for k := range rest {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		tag += fmt.Sprintf(" %s=\"%s\"", k, escape(rest[k]))
+	}
+	return tag + m[3] + s[len(m[0]):]
 }
 
 // Wrap text with specific tag.
@@ -533,82 +863,111 @@ func wrap(tag, body string) string {
 	return fmt.Sprintf("<%[1]s>%s</%[1]s>", tag, body)
 }
 
-// Group all text configuration in one place(escaping, smartypants, etc..)
+// Group all text configuration in one place(entities, smartypants, etc..)
+// The returned text is decoded, and it's escaped only when it's rendered.
 func (p *parse) text(input string) string {
 	opts := p.root().options
-	if opts.Smartypants {
-		input = smartypants(input)
+	input = unescape(input)
+	if opts.Typographer {
+		input = typographer.Replace(input)
 	}
-	if opts.Fractions {
-		input = smartyfractions(input)
+	if opts.Smartypants {
+		input = smartypants(input, opts.Smarty)
 	}
-	return escape(input)
+	return input
 }
 
 // Helper escaper
-func escape(str string) (cpy string) {
-	emp := regexp.MustCompile(`&\w+;`)
-	for i := 0; i < len(str); i++ {
-		switch s := str[i]; s {
-		case '>':
-			cpy += "&gt;"
-		case '"':
-			cpy += "&quot;"
-		case '\'':
-			cpy += "&#39;"
-		case '<':
-			if res := reHTML.tag.FindString(str[i:]); res != "" {
-				cpy += res
-				i += len(res) - 1
-			} else {
-				cpy += "&lt;"
+func escape(str string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;", "'", "&#39;").Replace(str)
+}
+
+// unescape decodes the entity and numeric character references in the given text.
+func unescape(str string) string {
+	return reEntity.ReplaceAllStringFunc(str, func(ref string) string {
+		s := html.UnescapeString(ref)
+		// Keep unknown entities as is
+		if s == ref {
+			return s
+		}
+		// html.UnescapeString maps the C1 range(0x80-0x9F) to windows-1252,
+		// but a numeric reference always stands for its code point.
+		if ref[1] == '#' {
+			n, base := ref[2:len(ref)-1], 10
+			if n[0] == 'x' || n[0] == 'X' {
+				n, base = n[1:], 16
 			}
-		case '&':
-			if res := emp.FindString(str[i:]); res != "" {
-				cpy += res
-				i += len(res) - 1
-			} else {
-				cpy += "&amp;"
+			if c, err := strconv.ParseInt(n, base, 32); err == nil && c >= 0x80 && c <= 0x9f {
+				return string(rune(c))
 			}
-		default:
-			cpy += str[i : i+1]
 		}
-	}
-	return
+		return s
+	})
 }
 
+// Typographic replacements, used when the Typographer option is enabled.
+var typographer = strings.NewReplacer(
+	"(c)", "\u00a9", "(C)", "\u00a9",
+	"(r)", "\u00ae", "(R)", "\u00ae",
+	"(tm)", "\u2122", "(TM)", "\u2122", "(Tm)", "\u2122", "(tM)", "\u2122",
+	// Long arrows(e.g: the end of HTML comments) are kept
+	"-->", "-->", "<--", "<--",
+	"->", "\u2192", "<-", "\u2190", "+-", "\u00b1", "...", "\u2026",
+)
+
 // Smartypants transformation helper, translate from marked.js
-func smartypants(text string) string {
-	// em-dashes, en-dashes, ellipses
-	re := strings.NewReplacer("---", "\u2014", "--", "\u2013", "...", "\u2026")
-	text = re.Replace(text)
+func smartypants(text string, opts *SmartyOptions) string {
+	if opts == nil {
+		opts = &SmartyOptions{}
+	}
+	// em-dashes, en-dashes, ellipses, guillemets
+	var pairs []string
+	if !opts.NoDashes {
+		dash := "\u2013"
+		if opts.EmDashes {
+			dash = "\u2014"
+		}
+		pairs = append(pairs, "---", "\u2014", "--", dash)
+	}
+	if !opts.NoEllipses {
+		pairs = append(pairs, "...", "\u2026")
+	}
+	if opts.Angled {
+		pairs = append(pairs, "<<", "\u00ab", ">>", "\u00bb")
+	}
+	text = strings.NewReplacer(pairs...).Replace(text)
+	if opts.NoQuotes {
+		return text
+	}
+	q := opts.Quotes
+	if q == nil {
+		q = &EnglishQuotes
+	}
+	// apostrophes
+	text = regexp.MustCompile(`(\pL)'(\pL)`).ReplaceAllString(text, "$1\u2019$2")
 	// opening singles
-	text = regexp.MustCompile("(^|[-\u2014/(\\[{\"\\s])'").ReplaceAllString(text, "$1\u2018")
-	// closing singles & apostrophes
-	text = strings.Replace(text, "'", "\u2019", -1)
+	text = regexp.MustCompile("(^|[-\u2014/(\\[{\"\\s])'").ReplaceAllString(text, "${1}"+q.OpenSingle)
+	// closing singles
+	text = strings.Replace(text, "'", q.CloseSingle, -1)
 	// opening doubles
-	text = regexp.MustCompile("(^|[-\u2014/(\\[{\u2018\\s])\"").ReplaceAllString(text, "$1\u201c")
+	text = regexp.MustCompile("(^|[-\u2014/(\\[{\\s]|"+regexp.QuoteMeta(q.OpenSingle)+")\"").ReplaceAllString(text, "${1}"+q.Open)
 	// closing doubles
-	text = strings.Replace(text, "\"", "\u201d", -1)
+	text = strings.Replace(text, "\"", q.Close, -1)
 	return text
 }
 
-// Smartyfractions transformation helper.
-func smartyfractions(text string) string {
-	re := regexp.MustCompile(`(\d+)(/\d+)(/\d+|)`)
-	return re.ReplaceAllStringFunc(text, func(str string) string {
-		var match []string
-		// If it's date like
-		if match = re.FindStringSubmatch(str); match[3] != "" {
-			return str
-		}
-		switch n := match[1] + match[2]; n {
-		case "1/2", "1/3", "2/3", "1/4", "3/4", "1/5", "2/5", "3/5", "4/5",
-			"1/6", "5/6", "1/7", "1/8", "3/8", "5/8", "7/8":
-			return fmt.Sprintf("&frac%s;", strings.Replace(n, "/", "", 1))
-		default:
-			return fmt.Sprintf("<sup>%s</sup>&frasl;<sub>%s</sub>",
-				match[1], strings.Replace(match[2], "/", "", 1))
-		}
-	})
+// vulgarFractions holds the fractions that have a unicode character.
+var vulgarFractions = map[string]string{
+	"1/2": "\u00bd", "1/3": "\u2153", "2/3": "\u2154", "1/4": "\u00bc", "3/4": "\u00be",
+	"1/5": "\u2155", "2/5": "\u2156", "3/5": "\u2157", "4/5": "\u2158", "1/6": "\u2159",
+	"5/6": "\u215a", "1/7": "\u2150", "1/8": "\u215b", "3/8": "\u215c", "5/8": "\u215d",
+	"7/8": "\u215e", "1/9": "\u2151", "1/10": "\u2152", "0/3": "\u2189",
 }
+
+// superscripts and subscripts replace the digits of a fraction in FractionsUnicode mode.
+var (
+	superscripts = strings.NewReplacer("0", "\u2070", "1", "\u00b9", "2", "\u00b2", "3", "\u00b3", "4", "\u2074",
+		"5", "\u2075", "6", "\u2076", "7", "\u2077", "8", "\u2078", "9", "\u2079")
+	subscripts = strings.NewReplacer("0", "\u2080", "1", "\u2081", "2", "\u2082", "3", "\u2083", "4", "\u2084",
+		"5", "\u2085", "6", "\u2086", "7", "\u2087", "8", "\u2088", "9", "\u2089")
+)
@@ -1,7 +1,9 @@
 package mark
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -18,63 +20,217 @@ type parse struct {
 	token     [3]item                 // three-token lookahead for parser
 	links     map[string]*DefLinkNode // Deflink parsing, used RefLinks
 	renderFn  map[NodeType]RenderFn   // Custom overridden fns
+	rules     map[rune][]InlineFn     // Custom inline rules
+	blocks    []*BlockRule            // Custom block rules
+	diagrams  map[string]DiagramFn    // Diagram hooks, by code language
+	attrs     []AttributesFn          // Attributes hooks
+	input     string                  // The lexed input
+	offsets   []Pos                   // Positions of the input in the parent input
+	tasks     []*CheckboxNode         // Task list checkboxes, in document order
+	inLink    int                     // Nesting level of link texts
+	starts    []Pos                   // Start positions of the nodes, used by Document
+	spans     map[Node][2]Pos         // Source spans of the blocks, used by SourcePos
+	refs      map[string]bool         // Labels of the link definitions, see reDefLabel
 }
 
 // Return new parser
-func newParse(input string, opts *Options) *parse {
-	return &parse{
-		lex:      lex(input),
+// The lexing starts on the first parse, to let the block rules be registered.
+func newParse(opts *Options) *parse {
+	p := &parse{
 		options:  opts,
 		links:    make(map[string]*DefLinkNode),
 		renderFn: make(map[NodeType]RenderFn),
+		rules:    make(map[rune][]InlineFn),
+		diagrams: make(map[string]DiagramFn),
+	}
+	// Built-in inline and block rules
+	if opts.SourcePos {
+		p.spans = make(map[Node][2]Pos)
+	}
+	if opts.HardWraps {
+		p.rules['\n'] = append(p.rules['\n'], func(string) (int, Node) {
+			return 1, p.newBr(0)
+		})
 	}
+	if opts.Emoji {
+		p.rules[':'] = append(p.rules[':'], p.parseEmoji)
+	}
+	if opts.Math {
+		p.rules['$'] = append(p.rules['$'], p.parseMath)
+		p.blocks = append(p.blocks, &BlockRule{
+			Start: func(s string) bool {
+				return strings.HasPrefix(strings.TrimLeft(s, " "), "$$")
+			},
+			Scan: func(s string) int {
+				return len(reMath.block.FindString(s))
+			},
+			Node: func(src string, _ func(string) []Node) Node {
+				return p.newMath(0, strings.TrimSpace(reMath.block.FindStringSubmatch(src)[1]), true, true)
+			},
+		})
+	}
+	return p
 }
 
 // parse convert the raw text to Nodeparse.
 func (p *parse) parse() {
-Loop:
+	p.parseUntil(func(item) bool { return false })
+}
+
+// parseUntil parses the blocks until the end of the input, or until stop
+// returns true for the first token of a block.
+func (p *parse) parseUntil(stop func(t item) bool) {
+	follows := false
 	for {
-		var n Node
-		switch t := p.peek(); t.typ {
-		case itemEOF, itemError:
-			break Loop
-		case itemNewLine:
-			p.next()
-		case itemHr:
-			n = p.newHr(p.next().pos)
-		case itemHTML:
-			t = p.next()
-			n = p.newHTML(t.pos, t.val)
-		case itemDefLink:
-			n = p.parseDefLink()
-		case itemHeading, itemLHeading:
-			n = p.parseHeading()
-		case itemCodeBlock, itemGfmCodeBlock:
-			n = p.parseCodeBlock()
-		case itemList:
-			n = p.parseList()
-		case itemTable, itemLpTable:
-			n = p.parseTable()
-		case itemBlockQuote:
-			n = p.parseBlockQuote()
-		case itemIndent:
-			space := p.next()
-			// If it isn't followed by itemText
-			if p.peek().typ != itemText {
-				continue
-			}
-			p.backup2(space)
-			fallthrough
-		// itemText
-		default:
-			tmp := p.newParagraph(t.pos)
-			tmp.Nodes = p.parseText(p.next().val + p.scanLines())
-			n = tmp
+		t := p.peek()
+		// A setext heading that directly follows a block, may be lexed in the
+		// middle of its text. it can't be lexed from its own position, so it
+		// shares the start position of the previous block.
+		joined := t.typ == itemLHeading && follows
+		if t.typ == itemEOF || t.typ == itemError || !joined && stop(t) {
+			break
+		}
+		n := p.parseBlock()
+		if follows = n != nil; n == nil {
+			continue
+		}
+		start := t.pos
+		if joined {
+			start = p.starts[len(p.starts)-1]
+		}
+		p.append(n)
+		p.starts = append(p.starts, start)
+		p.setSpan(n, t.typ, t.pos, p.peek().pos)
+	}
+}
+
+// parseBlock parses the next block, it returns nil if the consumed
+// tokens doesn't produce a node(e.g: new-lines).
+func (p *parse) parseBlock() (n Node) {
+	switch t := p.peek(); t.typ {
+	case itemNewLine:
+		p.next()
+	case itemHr:
+		n = p.newHr(p.next().pos)
+	case itemHTML:
+		t = p.next()
+		n = p.newHTML(t.pos, t.val)
+	case itemDefLink:
+		n = p.parseDefLink()
+	case itemHeading, itemLHeading:
+		n = p.parseHeading()
+	case itemCodeBlock, itemGfmCodeBlock:
+		n = p.parseCodeBlock()
+	case itemList:
+		n = p.parseList()
+	case itemTable, itemLpTable:
+		n = p.parseTable(nil)
+	case itemBlockQuote:
+		n = p.parseBlockQuote()
+	case itemBlockRule:
+		n = p.parseBlockRule()
+	case itemIndent:
+		space := p.next()
+		// If it isn't followed by itemText
+		if p.peek().typ != itemText {
+			break
+		}
+		p.backup2(space)
+		fallthrough
+	// itemText
+	default:
+		text := p.next().val + p.scanLines()
+		if table := p.parseTableHead(t.pos, text); table != nil {
+			n = table
+			break
+		}
+		tmp := p.newParagraph(t.pos)
+		tmp.Nodes = p.parseText(t.pos, text)
+		n = tmp
+	}
+	return
+}
+
+// scanRefs scans the labels of the link definitions in the input, before the
+// parsing. the definitions may follow their references, and the inline lexer
+// needs them to resolve the references before the emphasis.
+func (p *parse) scanRefs(input string) {
+	p.refs = make(map[string]bool)
+	for _, m := range reDefLabel.FindAllStringSubmatch(input, -1) {
+		p.refs[strings.ToLower(m[1])] = true
+	}
+}
+
+// setSpan records the source span of a block, if SourcePos is enabled.
+// start and end are positions in the input of the parser, the surrounding
+// spaces are excluded, and the span is recorded in root input positions.
+func (p *parse) setSpan(n Node, typ itemType, start, end Pos) {
+	root := p.root()
+	if root.spans == nil {
+		return
+	}
+	if end > Pos(len(p.input)) {
+		end = Pos(len(p.input))
+	}
+	// The indentation is a part of an indented code block
+	cut := " \n"
+	if typ == itemCodeBlock {
+		cut = "\n"
+	}
+	s := strings.TrimLeft(p.input[start:end], cut)
+	if s = strings.TrimRight(s, " \n"); s == "" {
+		return
+	}
+	start = end - Pos(len(strings.TrimLeft(p.input[start:end], cut)))
+	end = start + Pos(len(s))
+	root.spans[n] = [2]Pos{p.source(start), p.source(end - 1)}
+}
+
+// sub returns a parser for a nested block(blockquote, list-item).
+// it shares the options, links and render functions of the root parser.
+// offsets maps each byte of the nested input to its position in the parent input.
+func (p *parse) sub(input string, offsets []Pos) *parse {
+	root := p.root()
+	return &parse{
+		lex:      lex(input, root.blocks),
+		input:    input,
+		offsets:  offsets,
+		tr:       p,
+		options:  root.options,
+		links:    root.links,
+		renderFn: root.renderFn,
+		rules:    root.rules,
+		blocks:   root.blocks,
+	}
+}
+
+// source returns the position in the root input, of the given position.
+func (p *parse) source(pos Pos) Pos {
+	if p.tr == nil {
+		return pos
+	}
+	if int(pos) < len(p.offsets) {
+		pos = p.offsets[pos]
+	}
+	return p.tr.source(pos)
+}
+
+// align maps each byte of s to its position in input. s is derived from
+// input[start:] by removing some of its characters(e.g: indentation, or
+// blockquote markers).
+func align(input string, start Pos, s string) []Pos {
+	offsets := make([]Pos, len(s))
+	j := int(start)
+	for i := 0; i < len(s); i++ {
+		for j < len(input) && input[j] != s[i] {
+			j++
 		}
-		if n != nil {
-			p.append(n)
+		offsets[i] = Pos(j)
+		if j < len(input) {
+			j++
 		}
 	}
+	return offsets
 }
 
 // Root getter
@@ -87,18 +243,15 @@ func (p *parse) root() *parse {
 
 // Render parse nodes to the wanted output
 func (p *parse) render() {
-	var output string
-	for i, node := range p.Nodes {
+	r := p.renderer()
+	for _, node := range p.Nodes {
 		// If there's a custom render function, use it instead.
-		if fn, ok := p.renderFn[node.Type()]; ok {
-			output = fn(node)
-		} else {
-			output = node.Render()
-		}
-		p.output += output
-		if output != "" && i != len(p.Nodes)-1 {
+		output := r.render(node)
+		// Transparent nodes(e.g: DefLinkNode) are not separated
+		if output != "" && p.output != "" {
 			p.output += "\n"
 		}
+		p.output += output
 	}
 }
 
@@ -140,18 +293,50 @@ func (p *parse) backup2(t1 item) {
 }
 
 // parseText
-func (p *parse) parseText(input string) (nodes []Node) {
+func (p *parse) parseText(pos Pos, input string) []Node {
 	// Trim whitespaces that not a line-break
+	spaceBreaks := !p.root().options.NoSpaceBreaks
 	input = regexp.MustCompile(`(?m)^ +| +(\n|$)`).ReplaceAllStringFunc(input, func(s string) string {
-		if reBr.MatchString(s) {
+		if reBr.MatchString(s) && spaceBreaks {
 			return s
 		}
 		return strings.Replace(s, " ", "", -1)
 	})
-	l := lexInline(input)
+	// The inline parser positions the nodes in the root input,
+	// using the offsets of the trimmed input
+	root := p.root()
+	tr := &parse{
+		input:    input,
+		offsets:  align(p.input, pos, input),
+		tr:       p,
+		options:  root.options,
+		links:    root.links,
+		renderFn: root.renderFn,
+		rules:    root.rules,
+		blocks:   root.blocks,
+		inLink:   p.inLink,
+	}
+	return tr.parseInline(input)
+}
+
+// parseInline parses the inline content of a block.
+func (p *parse) parseInline(input string) (nodes []Node) {
+	root := p.root()
+	l := lexInline(input, root.rules, root.refs)
+	// The end of an attribute list that follows a link or an image
+	var skip Pos
 	for token := range l.items {
 		var node Node
+		if end := token.pos + Pos(len(token.val)); token.pos < skip {
+			if end <= skip || token.typ != itemText {
+				continue
+			}
+			token.val, token.pos = token.val[skip-token.pos:], skip
+		}
 		switch token.typ {
+		case itemInlineRule:
+			node = l.nodes[token.pos]
+			setPos(node, p.source(token.pos))
 		case itemBr:
 			node = p.newBr(token.pos)
 		case itemStrong, itemItalic, itemStrike, itemCode:
@@ -161,7 +346,7 @@ func (p *parse) parseText(input string) (nodes []Node) {
 			var text []Node
 			if token.typ == itemLink {
 				match := reLink.FindStringSubmatch(token.val)
-				text = p.parseText(match[1])
+				text = p.parseLinkText(token.pos+1, match[1])
 				href, title = match[2], match[3]
 			} else {
 				var match []string
@@ -170,13 +355,20 @@ func (p *parse) parseText(input string) (nodes []Node) {
 				} else {
 					match = reAutoLink.FindStringSubmatch(token.val)
 				}
+				// URLs are taken literally
 				href = match[1]
-				text = append(text, p.newText(token.pos, match[1]))
+				text = append(text, &TextNode{NodeType: NodeText, Pos: p.source(token.pos), Text: match[1]})
+			}
+			link := p.newLink(token.pos, title, href, text...)
+			if token.typ == itemLink {
+				link.Attrs, skip = p.parseAttrList(input, token)
 			}
-			node = p.newLink(token.pos, title, href, text...)
+			node = link
 		case itemImage:
 			match := reImage.FindStringSubmatch(token.val)
-			node = p.newImage(token.pos, match[3], match[2], match[1])
+			image := p.newImage(token.pos, match[3], match[2], match[1])
+			image.Attrs, skip = p.parseAttrList(input, token)
+			node = image
 		case itemRefLink, itemRefImage:
 			match := reRefLink.FindStringSubmatch(token.val)
 			text, ref := match[1], match[2]
@@ -184,13 +376,17 @@ func (p *parse) parseText(input string) (nodes []Node) {
 				ref = text
 			}
 			if token.typ == itemRefLink {
-				node = p.newRefLink(token.typ, token.pos, token.val, ref, p.parseText(text))
+				node = p.newRefLink(token.typ, token.pos, token.val, ref, p.parseLinkText(token.pos+1, text))
 			} else {
 				node = p.newRefImage(token.typ, token.pos, token.val, ref, text)
 			}
 		case itemHTML:
 			node = p.newHTML(token.pos, token.val)
 		default:
+			if p.root().options.Fractions && p.inLink == 0 {
+				nodes = append(nodes, p.parseFractions(token.pos, token.val)...)
+				continue
+			}
 			node = p.newText(token.pos, token.val)
 		}
 		nodes = append(nodes, node)
@@ -198,29 +394,124 @@ func (p *parse) parseText(input string) (nodes []Node) {
 	return nodes
 }
 
+// parseLinkText parses the text of a link. Fractions are not rendered in links.
+func (p *parse) parseLinkText(pos Pos, input string) []Node {
+	p.inLink++
+	defer func() { p.inLink-- }()
+	return p.parseText(pos, input)
+}
+
+// parseAttrList parses the attribute list that immediately follows the given
+// token(link or image), and returns its attributes and its end position.
+func (p *parse) parseAttrList(input string, token item) (map[string]string, Pos) {
+	end := token.pos + Pos(len(token.val))
+	if !p.root().options.AttributeLists {
+		return nil, end
+	}
+	m := reAttrList.prefix.FindStringSubmatch(input[end:])
+	if m == nil {
+		return nil, end
+	}
+	return parseAttrs(m[1]), end + Pos(len(m[0]))
+}
+
+// parseFractions parses text with fractions, based on the fractions mode.
+// Date like fractions, and fractions that are part of a path or a version
+// string(e.g: 2015/1/2, /1/2, 1.1/2) are ignored.
+func (p *parse) parseFractions(pos Pos, text string) (nodes []Node) {
+	opts := p.root().options
+	var start int
+	for _, m := range reFraction.FindAllStringSubmatchIndex(text, -1) {
+		if m[6] != m[7] || !isFraction(text, m[0], m[1]) {
+			continue
+		}
+		if m[0] > start {
+			nodes = append(nodes, p.newText(pos+Pos(start), text[start:m[0]]))
+		}
+		num, den := text[m[2]:m[3]], text[m[4]+1:m[5]]
+		glyph := vulgarFractions[num+"/"+den]
+		switch {
+		case opts.FractionFn != nil:
+			nodes = append(nodes, p.newHTML(pos+Pos(m[0]), opts.FractionFn(num, den)))
+		case opts.FractionsMode == FractionsSlash:
+			nodes = append(nodes, p.newText(pos+Pos(m[0]), num+"\u2044"+den))
+		case glyph != "":
+			nodes = append(nodes, p.newText(pos+Pos(m[0]), glyph))
+		case opts.FractionsMode == FractionsUnicode:
+			nodes = append(nodes, p.newText(pos+Pos(m[0]), superscripts.Replace(num)+"\u2044"+subscripts.Replace(den)))
+		default:
+			src := fmt.Sprintf("<sup>%s</sup>&#8260;<sub>%s</sub>", num, den)
+			nodes = append(nodes, p.newHTML(pos+Pos(m[0]), src))
+		}
+		start = m[1]
+	}
+	if start < len(text) {
+		nodes = append(nodes, p.newText(pos+Pos(start), text[start:]))
+	}
+	return
+}
+
+// isFraction tests if text[start:end] is a standalone fraction, and not
+// a part of a path, a URL or a version string.
+func isFraction(text string, start, end int) bool {
+	if start > 0 {
+		if r, _ := utf8.DecodeLastRuneInString(text[:start]); r == '.' || r == '/' || r == '_' ||
+			unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+	rest := text[end:]
+	return !strings.HasPrefix(rest, "/") && (!strings.HasPrefix(rest, ".") || !isDigit(rest[1:]))
+}
+
 // parse inline emphasis
 func (p *parse) parseEmphasis(typ itemType, pos Pos, val string) *EmphasisNode {
-	var re *regexp.Regexp
+	var text string
+	node := p.newEmphasis(pos, typ)
 	switch typ {
-	case itemStrike:
-		re = reStrike
+	// The delimiters were already matched by the lexer
 	case itemStrong:
-		re = reStrong
-	case itemCode:
-		re = reCode
+		text = val[2 : len(val)-2]
 	case itemItalic:
-		re = reItalic
-	}
-	node := p.newEmphasis(pos, typ)
-	match := re.FindStringSubmatch(val)
-	text := match[len(match)-1]
-	if text == "" {
-		text = match[1]
+		text = val[1 : len(val)-1]
+	// Code spans content is taken literally
+	case itemCode:
+		m := reCode.FindStringSubmatchIndex(val)
+		text = val[m[2]:m[3]]
+		node.Nodes = []Node{&TextNode{NodeType: NodeText, Pos: p.source(pos + Pos(m[2])), Text: text}}
+		return node
+	default:
+		text = reStrike.FindStringSubmatch(val)[1]
 	}
-	node.Nodes = p.parseText(text)
+	// The delimiters are on both sides of the text
+	node.Nodes = p.parseText(pos+Pos(len(val)-len(text))/2, text)
 	return node
 }
 
+// parseEmoji is an inline rule that parses emoji shortcodes.
+func (p *parse) parseEmoji(input string) (int, Node) {
+	if m := reEmoji.FindStringSubmatch(input); m != nil {
+		if glyph, ok := emojis[m[1]]; ok {
+			return len(m[0]), p.newEmoji(m[1], glyph)
+		}
+	}
+	return 0, nil
+}
+
+// parseMath is an inline rule that parses inline and display math expressions.
+// The expression is taken literally(no emphasis or escaping).
+func (p *parse) parseMath(input string) (int, Node) {
+	if m := reMath.display.FindStringSubmatch(input); m != nil {
+		return len(m[0]), p.newMath(0, strings.TrimSpace(m[1]), true, false)
+	}
+	m := reMath.inline.FindStringSubmatch(input)
+	// The closing dollar sign can't be followed by a digit(e.g: $5 and $6)
+	if m == nil || len(input) > len(m[0]) && isDigit(input[len(m[0]):]) {
+		return 0, nil
+	}
+	return len(m[0]), p.newMath(0, m[1], false, false)
+}
+
 // parse heading block
 func (p *parse) parseHeading() (node *HeadingNode) {
 	token := p.next()
@@ -237,11 +528,32 @@ func (p *parse) parseHeading() (node *HeadingNode) {
 			level = 2
 		}
 	}
+	var attrs map[string]string
+	if m := reAttrList.suffix.FindStringSubmatch(text); m != nil && p.root().options.AttributeLists {
+		text, attrs = text[:len(text)-len(m[0])], parseAttrs(m[1])
+	}
 	node = p.newHeading(token.pos, level, text)
-	node.Nodes = p.parseText(text)
+	node.Nodes = p.parseText(token.pos+Pos(strings.Index(token.val, text)), text)
+	node.Attrs = attrs
 	return
 }
 
+// parseAttrs parses the content of an attribute list(e.g: #id .class key=val).
+func parseAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range reAttrList.attr.FindAllStringSubmatch(s, -1) {
+		switch m[1] {
+		case "#":
+			attrs["id"] = m[2]
+		case ".":
+			attrs["class"] = strings.TrimSpace(attrs["class"] + " " + m[2])
+		default:
+			attrs[m[3]] = m[4] + m[5] + m[6]
+		}
+	}
+	return attrs
+}
+
 func (p *parse) parseDefLink() *DefLinkNode {
 	token := p.next()
 	match := reDefLink.FindStringSubmatch(token.val)
@@ -257,40 +569,120 @@ func (p *parse) parseDefLink() *DefLinkNode {
 }
 
 // parse codeBlock
-func (p *parse) parseCodeBlock() *CodeNode {
+func (p *parse) parseCodeBlock() Node {
 	var lang, text string
+	var attrs map[string]string
 	token := p.next()
 	if token.typ == itemGfmCodeBlock {
 		codeStart := reGfmCode.FindStringSubmatch(token.val)
 		lang = codeStart[3]
 		text = token.val[len(codeStart[0]):]
+		// Attribute list in the info string. i.e: "```go {#main .numbers}",
+		// or "```{.go .numbers}", where the first class is the language.
+		if m := reAttrList.suffix.FindStringSubmatch(codeStart[0]); m != nil && p.root().options.AttributeLists {
+			attrs = parseAttrs(m[1])
+			if strings.HasPrefix(lang, "{") {
+				classes := strings.Fields(attrs["class"])
+				lang = ""
+				if len(classes) > 0 {
+					lang, attrs["class"] = classes[0], strings.Join(classes[1:], " ")
+				}
+				if attrs["class"] == "" {
+					delete(attrs, "class")
+				}
+			}
+		}
 	} else {
 		text = reCodeBlock.trim(token.val, "")
 	}
-	return p.newCode(token.pos, lang, text)
+	// ```math fenced block
+	if lang == "math" && p.root().options.Math {
+		return p.newMath(token.pos, strings.Trim(text, "\n"), true, true)
+	}
+	code := p.newCode(token.pos, lang, text)
+	code.Attrs = attrs
+	return code
 }
 
-func (p *parse) parseBlockQuote() (n *BlockQuoteNode) {
+func (p *parse) parseBlockQuote() Node {
 	token := p.next()
 	// replacer
 	re := regexp.MustCompile(`(?m)^ *> ?`)
 	raw := re.ReplaceAllString(token.val, "")
-	// TODO(a8m): doesn't work right now with defLink(inside the blockQuote)
-	tr := &parse{lex: lex(raw), tr: p}
+	// GitHub-style alert
+	offsets := align(p.input, token.pos, raw)
+	if m := reAlert.FindStringSubmatch(raw); m != nil && p.root().options.Alerts {
+		n := p.newAlert(token.pos, strings.ToLower(m[1]))
+		n.Nodes = p.parseBlocks(raw[len(m[0]):], offsets[len(m[0]):])
+		return n
+	}
+	n := p.newBlockQuote(token.pos)
+	n.Nodes = p.parseBlocks(raw, offsets)
+	return n
+}
+
+// parse custom block, using the node constructor of its rule.
+func (p *parse) parseBlockRule() Node {
+	token := p.next()
+	// The rule that scanned the block, recorded by the lexer
+	l, ok := p.lex.(*lexer)
+	if !ok {
+		return nil
+	}
+	rule, ok := l.matched.Load(token.pos)
+	if !ok {
+		return nil
+	}
+	n := rule.(*BlockRule).Node(token.val, func(input string) []Node {
+		start := token.pos
+		if i := strings.Index(token.val, input); i > 0 {
+			start += Pos(i)
+		}
+		return p.parseBlocks(input, align(p.input, start, input))
+	})
+	setPos(n, p.source(token.pos))
+	return n
+}
+
+// setPos sets the position of a node created by a built-in rule(math, emoji and
+// hard line-breaks). the rules are called without the position of their input.
+func setPos(n Node, pos Pos) {
+	switch n := n.(type) {
+	case *MathNode:
+		n.Pos = pos
+	case *EmojiNode:
+		n.Pos = pos
+	case *BrNode:
+		n.Pos = pos
+	}
+}
+
+// parseBlocks parses a nested markdown content.
+func (p *parse) parseBlocks(input string, offsets []Pos) []Node {
+	tr := p.sub(input, offsets)
 	tr.parse()
-	n = p.newBlockQuote(token.pos)
-	n.Nodes = tr.Nodes
-	return
+	return tr.Nodes
 }
 
 // parse list
 func (p *parse) parseList() *ListNode {
 	token := p.next()
 	list := p.newList(token.pos, isDigit(token.val))
+	// The marker of the first item, i.e: "3." or "*"
+	if marker := token.val; list.Ordered {
+		list.Start, _ = strconv.Atoi(marker[:len(marker)-1])
+		list.Delimiter = rune(marker[len(marker)-1])
+	} else {
+		list.BulletChar = rune(marker[0])
+	}
+	list.Tight = true
 Loop:
 	for {
 		switch token = p.peek(); token.typ {
 		case itemLooseItem, itemListItem:
+			if token.typ == itemLooseItem {
+				list.Tight = false
+			}
 			list.append(p.parseListItem())
 		default:
 			break Loop
@@ -304,11 +696,14 @@ func (p *parse) parseListItem() *ListItemNode {
 	token := p.next()
 	item := p.newListItem(token.pos)
 	token.val = strings.TrimSpace(token.val)
+	offsets := align(p.input, token.pos, token.val)
+	var checkbox *CheckboxNode
 	if p.isTaskItem(token.val) {
-		item.Nodes = p.parseTaskItem(token)
-		return item
+		checkbox = p.newCheckbox(offsets[0], token.val[1] != ' ')
+		i := len(token.val) - len(strings.TrimLeft(token.val[3:], " \n"))
+		token.val, offsets = token.val[i:], offsets[i:]
 	}
-	tr := &parse{lex: lex(token.val), tr: p}
+	tr := p.sub(token.val, offsets)
 	tr.parse()
 	for _, node := range tr.Nodes {
 		// wrap with paragraph only when it's a loose item
@@ -318,27 +713,43 @@ func (p *parse) parseListItem() *ListItemNode {
 			item.append(node)
 		}
 	}
+	if n := len(offsets); n > 0 {
+		p.setSpan(item, token.typ, token.pos, offsets[n-1]+1)
+	} else {
+		p.setSpan(item, token.typ, token.pos, token.pos+1)
+	}
+	if checkbox == nil {
+		return item
+	}
+	// The checkbox is placed in the first paragraph of a loose item.
+	// A task that doesn't start with a paragraph is parsed as a simple text.
+	var first Node
+	if len(tr.Nodes) > 0 {
+		first = tr.Nodes[0]
+	}
+	if n, ok := first.(*ParagraphNode); !ok {
+		item.Nodes = append([]Node{checkbox}, p.parseText(offsets[0], token.val)...)
+	} else if token.typ == itemLooseItem {
+		n.Nodes = append([]Node{checkbox}, n.Nodes...)
+	} else {
+		item.Nodes = append([]Node{checkbox}, item.Nodes...)
+	}
 	return item
 }
 
-// parseTaskItem parses list item as a task item.
-func (p *parse) parseTaskItem(token item) []Node {
-	checkbox := p.newCheckbox(token.pos, token.val[1] == 'x')
-	token.val = strings.TrimSpace(token.val[3:])
-	return append([]Node{checkbox}, p.parseText(token.val)...)
-}
-
 // isTaskItem tests if the given string is list task item.
 func (p *parse) isTaskItem(s string) bool {
-	if len(s) < 5 || s[0] != '[' || (s[1] != 'x' && s[1] != ' ') || s[2] != ']' {
+	if len(s) < 5 || s[0] != '[' || !strings.ContainsRune(" xX", rune(s[1])) || s[2] != ']' {
 		return false
 	}
-	return "" != strings.TrimSpace(s[3:])
+	return (s[3] == ' ' || s[3] == '\n') && "" != strings.TrimSpace(s[3:])
 }
 
-// parse table
-func (p *parse) parseTable() *TableNode {
+// parse table. A MultiMarkdown table without a caption above it, may have
+// a caption below it.
+func (p *parse) parseTable(caption []Node) *TableNode {
 	table := p.newTable(p.next().pos)
+	table.Caption = caption
 	// Align	[ None, Left, Right, ... ]
 	// Header	[ Cells: [ ... ] ]
 	// Data:	[ Rows: [ Cells: [ ... ] ] ]
@@ -346,16 +757,18 @@ func (p *parse) parseTable() *TableNode {
 		Align  []AlignType
 		Header []item
 		Cells  [][]item
+		Pos    []Pos
 	}{}
 Loop:
 	for i := 0; ; {
 		switch token := p.next(); token.typ {
 		case itemTableRow:
 			i++
+			rows.Pos = append(rows.Pos, token.pos)
 			if i > 2 {
 				rows.Cells = append(rows.Cells, []item{})
 			}
-		case itemTableCell:
+		case itemTableCell, itemTableSpan:
 			// Header
 			if i == 1 {
 				rows.Header = append(rows.Header, token)
@@ -373,28 +786,160 @@ Loop:
 		}
 	}
 	// Tranform to nodes
-	table.append(p.parseCells(Header, rows.Header, rows.Align))
+	table.Align = rows.Align
+	pos := table.Pos
+	if len(rows.Pos) > 0 {
+		pos = rows.Pos[0]
+	}
+	table.Header = append(table.Header, p.parseCells(Header, pos, rows.Header, rows.Align))
 	// Table body
-	for _, row := range rows.Cells {
-		table.append(p.parseCells(Data, row, rows.Align))
+	mmd := p.root().options.MultiMarkdownTables
+	for i := 0; i < len(rows.Cells); i++ {
+		row, pos := rows.Cells[i], rows.Pos[i+2]
+		// Rows that end with a backslash continue on the next row
+		for ok := mmd; ok && i+1 < len(rows.Cells); {
+			if row, ok = continued(row); ok {
+				i++
+				row = joinCells(row, rows.Cells[i])
+			}
+		}
+		table.append(p.parseCells(Data, pos, row, rows.Align))
 	}
+	if mmd && table.Caption == nil {
+		table.Caption = p.parseCaption()
+	}
+	table.setRows()
 	return table
 }
 
-// parse cells and return new row
-func (p *parse) parseCells(kind int, items []item, align []AlignType) *RowNode {
-	var row *RowNode
-	for i, item := range items {
-		if i == 0 {
-			row = p.newRow(item.pos)
+// parse cells and return new row. The number of cells in the row is determined
+// by the delimiter row; excess cells are ignored, and missing cells are filled
+// with empty ones.
+// In MultiMarkdown tables, an empty cell with no spaces(i.e: "||") extends the
+// previous cell by one column.
+func (p *parse) parseCells(kind int, pos Pos, items []item, align []AlignType) *RowNode {
+	row := p.newRow(pos)
+	mmd := p.root().options.MultiMarkdownTables
+	for i, col := 0, 0; col < len(align); i++ {
+		if i >= len(items) {
+			row.append(p.newCell(pos, kind, align[col]))
+			col++
+			continue
+		}
+		if n := len(row.Cells); mmd && n > 0 && items[i].typ == itemTableSpan {
+			row.Cells[n-1].Colspan++
+			col++
+			continue
 		}
-		cell := p.newCell(item.pos, kind, align[i])
-		cell.Nodes = p.parseText(item.val)
+		cell := p.newCell(items[i].pos, kind, align[col])
+		cell.Nodes = p.parseText(items[i].pos, items[i].val)
 		row.append(cell)
+		col++
 	}
 	return row
 }
 
+// continued reports whether the last cell of a row ends with a backslash,
+// and returns the row without it.
+func continued(row []item) ([]item, bool) {
+	n := len(row)
+	if n == 0 {
+		return row, false
+	}
+	last := row[n-1].val
+	if !strings.HasSuffix(last, "\\") {
+		return row, false
+	}
+	if last = strings.TrimSpace(strings.TrimSuffix(last, "\\")); last == "" && n > 1 {
+		return row[:n-1], true
+	}
+	row[n-1].val = last
+	return row, true
+}
+
+// joinCells appends the content of each cell in next to its matching cell in row.
+func joinCells(row, next []item) []item {
+	row = row[:len(row):len(row)]
+	for i, cell := range next {
+		if i < len(row) {
+			row[i].val += "\n" + cell.val
+		} else {
+			row = append(row, cell)
+		}
+	}
+	return row
+}
+
+// parseTableHead parses a MultiMarkdown table, if the given paragraph
+// is immediately followed by a table, and contains a caption and/or
+// additional header rows.
+func (p *parse) parseTableHead(pos Pos, text string) *TableNode {
+	if !p.root().options.MultiMarkdownTables {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	m := reTable.caption.FindStringSubmatch(lines[0])
+	if m != nil {
+		lines = lines[1:]
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "|") {
+			return nil
+		}
+	}
+	t := p.next()
+	if t.typ != itemNewLine {
+		p.backup()
+		return nil
+	}
+	if next := p.peek().typ; next != itemTable && next != itemLpTable {
+		p.backup2(t)
+		return nil
+	}
+	var caption []Node
+	if m != nil {
+		caption = p.parseText(pos, m[1])
+	}
+	table := p.parseTable(caption)
+	table.Pos = p.source(pos)
+	var head []*RowNode
+	// The header rows are the last lines of the text
+	offsets, start := align(p.input, pos, text), len(text)-len(strings.Join(lines, "\n"))
+	for _, line := range lines {
+		var items []item
+		cells, starts := splitCells(line)
+		for i, cell := range cells {
+			typ := itemTableCell
+			if cell == "" {
+				typ = itemTableSpan
+			}
+			indent := len(cell) - len(strings.TrimLeft(cell, " \t"))
+			items = append(items, item{typ, offsets[start+starts[i]+indent], strings.TrimSpace(cell)})
+		}
+		head = append(head, p.parseCells(Header, offsets[start], items, table.Align))
+		start += len(line) + 1
+	}
+	table.Header = append(head, table.Header...)
+	table.setRows()
+	return table
+}
+
+// parseCaption consumes a MultiMarkdown table caption(i.e: "[Caption]"),
+// if the next line contains only a caption.
+func (p *parse) parseCaption() []Node {
+	t := p.next()
+	m := reTable.caption.FindStringSubmatch(t.val)
+	if t.typ != itemText || m == nil {
+		p.backup()
+		return nil
+	}
+	if next := p.peek().typ; next != itemNewLine && next != itemEOF {
+		p.backup2(t)
+		return nil
+	}
+	return p.parseText(t.pos+Pos(strings.Index(t.val, m[1])), m[1])
+}
+
 // Used to consume lines(itemText) for a continues paragraphs
 func (p *parse) scanLines() (s string) {
 	for {